@@ -0,0 +1,118 @@
+package main
+// probing each address a URL's host resolves to
+// or each address family
+
+import (
+  "context"
+  "fmt"
+  "log"
+  "net/url"
+  "time"
+)
+
+// pollAllIPs resolves r's host and polls each address as a backend
+// a backend is a copy of r pinned to one address, kept across polls
+// so its connections and error count carry over
+// r fails if any backend does
+func (r *Resource) pollAllIPs() string {
+  u, err := url.Parse(r.url)
+  if err != nil {
+    return r.fail(err)
+  }
+  res, err := r.resolver()
+  if err != nil {
+    return r.fail(err)
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), r.timeout())
+  addrs, err := res.LookupHost(ctx, u.Hostname())
+  cancel()
+  if err != nil {
+    return r.fail(err)
+  }
+  backends := make(map[string]*Resource)
+  r.backendStates = nil
+  failed := 0
+  for _, ip := range addrs {
+    b := r.backends[ip]
+    if b == nil {
+      c := *r
+      b = &c
+      b.probeAllIPs, b.pinIP = false, ip
+      b.errCount, b.client, b.backends = 0, nil, nil
+    }
+    start := time.Now()
+    s := b.Poll()
+    if b.errCount > 0 {
+      failed++
+    }
+    backends[ip] = b
+    r.backendStates = append(r.backendStates, r.backendState(ip, b, s, time.Since(start)))
+  }
+  r.backends = backends
+  if failed > 0 {
+    return r.fail(fmt.Errorf("%d of %d backends failing", failed, len(addrs)))
+  }
+  r.succeedBackends()
+  return fmt.Sprintf("%d backends OK", len(addrs))
+}
+
+// backendState is the State of backend b, reported as "url [label]",
+// after a poll that returned s and took d
+func (r *Resource) backendState(label string, b *Resource, s string, d time.Duration) State {
+  return State{url: r.url + " [" + label + "]", status: s, healthy: b.errCount == 0,
+    tlsHost: b.tlsHost, resumed: b.resumed, redirects: b.redirects, code: b.code,
+    latency: d, degraded: b.degraded, checked: time.Now(), marker: *deployMarker}
+}
+
+// succeedBackends records a poll whose backends were all healthy
+// r takes the worst code, most redirects and any degradation among them
+// the backends' own States carry their TLS handshakes
+func (r *Resource) succeedBackends() {
+  r.recordSuccess()
+  for _, b := range r.backends {
+    r.code = max(r.code, b.code)
+    r.redirects = max(r.redirects, b.redirects)
+    r.degraded = r.degraded || b.degraded
+  }
+}
+
+// families are the networks pollDualStack polls over, with their names
+var families = []struct{ network, name string }{{"tcp4", "IPv4"}, {"tcp6", "IPv6"}}
+
+// pollDualStack polls r over IPv4 and over IPv6 as backends
+// and fails unless both families are healthy
+// a URL healthy over only one family is the usual misconfiguration,
+// so that is alerted as inconsistent
+func (r *Resource) pollDualStack() string {
+  backends := make(map[string]*Resource)
+  r.backendStates = nil
+  var healthy, failing []string
+  for _, f := range families {
+    b := r.backends[f.network]
+    if b == nil {
+      c := *r
+      b = &c
+      b.dualStack, b.network = false, f.network
+      b.errCount, b.client, b.backends = 0, nil, nil
+    }
+    start := time.Now()
+    s := b.Poll()
+    if b.errCount > 0 {
+      failing = append(failing, f.name)
+    } else {
+      healthy = append(healthy, f.name)
+    }
+    backends[f.network] = b
+    r.backendStates = append(r.backendStates, r.backendState(f.name, b, s, time.Since(start)))
+  }
+  r.backends = backends
+  switch {
+  case len(failing) == 0:
+    r.succeedBackends()
+    return "dual-stack consistent, IPv4 and IPv6 OK"
+  case len(healthy) == 0:
+    return r.fail(fmt.Errorf("dual-stack consistent, IPv4 and IPv6 failing"))
+  }
+  log.Printf("Alert %s dual-stack inconsistent: %s OK, %s failing", r.url, healthy[0], failing[0])
+  return r.fail(fmt.Errorf("dual-stack inconsistent, %s failing", failing[0]))
+}
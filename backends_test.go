@@ -0,0 +1,71 @@
+package main
+
+import (
+  "log"
+  "net"
+  "net/http"
+  "os"
+  "strings"
+  "testing"
+)
+
+// serve serves h on the listeners until the test ends
+func serve(t *testing.T, h http.Handler, ls ...net.Listener) {
+  t.Helper()
+  srv := &http.Server{Handler: h}
+  for _, l := range ls {
+    go srv.Serve(l)
+  }
+  t.Cleanup(func() { srv.Close() })
+}
+
+func TestDualStack(t *testing.T) {
+  v6, err := net.Listen("tcp6", "[::1]:0")
+  if err != nil {
+    t.Skip("no IPv6 loopback:", err)
+  }
+  _, port, _ := net.SplitHostPort(v6.Addr().String())
+  v4, err := net.Listen("tcp4", "127.0.0.1:"+port)
+  if err != nil {
+    v6.Close()
+    t.Skip("port taken on IPv4:", err)
+  }
+  h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+  serve(t, h, v4, v6)
+  only4, err := net.Listen("tcp4", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  serve(t, h, only4)
+  _, port4, _ := net.SplitHostPort(only4.Addr().String())
+  // the stub resolves dual.test to both loopbacks
+  stub, _ := dnsStub(t)
+  var logs strings.Builder
+  log.SetOutput(&logs)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  r := &Resource{url: "http://dual.test:" + port + "/", dualStack: true, dnsServer: stub}
+  if s := r.Poll(); s != "dual-stack consistent, IPv4 and IPv6 OK" || r.errCount != 0 {
+    t.Fatalf("both families served: %s", s)
+  }
+  if len(r.backendStates) != 2 || r.backendStates[0].url != r.url+" [IPv4]" || r.backendStates[1].url != r.url+" [IPv6]" {
+    t.Fatalf("backend states %v, want one per family", r.backendStates)
+  }
+  for _, b := range r.backendStates {
+    if !b.healthy {
+      t.Fatalf("%s: %s", b.url, b.status)
+    }
+  }
+
+  // nothing listens on ::1 at the IPv4-only port
+  m := &Resource{url: "http://dual.test:" + port4 + "/", dualStack: true, dnsServer: stub}
+  if s := m.Poll(); s != "dual-stack inconsistent, IPv6 failing" || m.errCount != 1 {
+    t.Fatalf("only IPv4 served: %s", s)
+  }
+  if !m.backendStates[0].healthy || m.backendStates[1].healthy {
+    t.Fatalf("IPv4 healthy %v, IPv6 healthy %v", m.backendStates[0].healthy, m.backendStates[1].healthy)
+  }
+  if !strings.Contains(logs.String(), "Alert "+m.url+" dual-stack inconsistent: IPv4 OK, IPv6 failing") {
+    t.Fatalf("no inconsistency alert, logged %q", logs.String())
+  }
+}
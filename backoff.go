@@ -0,0 +1,34 @@
+package main
+// how long a URL waits for its next poll after failures
+// and how that wait comes back down once it succeeds again
+
+import "time"
+
+// backoffStable is how many healthy polls in a row
+// -backoff-reset hold needs before dropping the backoff
+const backoffStable = 3
+
+// interval returns how long r sleeps before its next poll
+func (r *Resource) interval() time.Duration {
+  return pollInterval + errTimeout*time.Duration(r.backoff)
+}
+
+// resetBackoff brings the backoff down after a healthy poll
+// immediate drops it, decay halves it, and hold keeps one step
+// until backoffStable healthy polls in a row
+func (r *Resource) resetBackoff() {
+  r.successes++
+  switch *backoffReset {
+  case "decay":
+    r.backoff /= 2
+  case "hold":
+    if r.backoff > 1 {
+      r.backoff = 1
+    }
+    if r.successes >= backoffStable {
+      r.backoff = 0
+    }
+  default:
+    r.backoff = 0
+  }
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+  "errors"
+  "testing"
+  "time"
+)
+
+func TestBackoffReset(t *testing.T) {
+  saved := *backoffReset
+  t.Cleanup(func() { *backoffReset = saved })
+  step := func(n int) time.Duration { return pollInterval + time.Duration(n)*errTimeout }
+  cases := map[string][]time.Duration{
+    // intervals after 4 failures, then after each of 4 healthy polls
+    "immediate": {step(4), step(0), step(0), step(0), step(0)},
+    "decay": {step(4), step(2), step(1), step(0), step(0)},
+    "hold": {step(4), step(1), step(1), step(0), step(0)},
+  }
+  for policy, want := range cases {
+    *backoffReset = policy
+    r := &Resource{url: "http://a"}
+    for i := 0; i < 4; i++ {
+      r.fail(errors.New("down"))
+    }
+    got := []time.Duration{r.interval()}
+    for i := 0; i < 4; i++ {
+      r.recordSuccess()
+      got = append(got, r.interval())
+    }
+    for i := range want {
+      if got[i] != want[i] {
+        t.Errorf("%s: intervals %v, want %v", policy, got, want)
+        break
+      }
+    }
+  }
+
+  // a failure during hold starts the count of healthy polls again
+  *backoffReset = "hold"
+  r := &Resource{url: "http://a"}
+  r.fail(errors.New("down"))
+  r.recordSuccess()
+  r.recordSuccess()
+  r.fail(errors.New("down"))
+  r.recordSuccess()
+  r.recordSuccess()
+  if r.interval() != step(1) {
+    t.Errorf("hold after an interrupted recovery: %v, want %v", r.interval(), step(1))
+  }
+  r.recordSuccess()
+  if r.interval() != step(0) {
+    t.Errorf("hold after 3 healthy polls: %v, want %v", r.interval(), step(0))
+  }
+}
@@ -3,8 +3,21 @@ package main
 // periodically printing their state
 
 import (
+  "context"
+  "crypto/sha256"
+  "crypto/tls"
+  "encoding/hex"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
   "log"
+  "math/rand/v2"
+  "net"
   "net/http"
+  "os"
+  "regexp"
+  "strings"
   "time"
 )
 
@@ -15,16 +28,107 @@ import (
 // channels allow you to pass ref to data structures
 // between goroutines
 const (
-  numPollers = 2 // # of goroutines to launch
+  numPollers = 2 // default # of goroutines to launch
   pollInterval = 60 * time.Second // how often to poll each URL
   statusInterval = 10 * time.Second // how often to log status
   errTimeout = 10 * time.Second // back-off timeout on error
+  throughputCap = 10 << 20 // max bytes downloaded when measuring throughput
+  throughputInterval = 10 * time.Minute // min time between throughput downloads
+  downloadTimeout = 2 * time.Minute // max time a throughput download may take
+  maxRedirects = 3 // redirects a poll may follow before the URL is degraded
+  bodyCap = 1 << 20 // max bytes of body read to check expectations
+  requestTimeout = 10 * time.Second // default timeout of a poll's request
+  minTimeout = 1 * time.Second // shortest timeout -timeout-policy shorten goes to
+  maxTimeout = 60 * time.Second // longest timeout -timeout-policy lengthen goes to
+  dnsRetryDelay = 200 * time.Millisecond // wait before retrying a failed DNS lookup
+  enrichTimeout = 2 * time.Second // the event goroutine waits at most this for -enrich-url
+  eventQueue = 256 // events waiting for enrichment before the StateMonitor blocks
+  maxResultPosts = 8 // max result webhook posts in flight, further results are dropped
 )
 
-var urls = []string{
-  "http://www.google.com",
-  "http://golang.org",
-  "http://blog.golang.org",
+// command line flags
+var (
+  requireURLs = flag.Bool("require-urls", false, "exit with an error when there are no URLs to poll")
+  maxHeaderBytes = flag.Int64("max-header-bytes", 1<<20, "max size of response headers before a poll fails")
+  maxInflight = flag.Int("max-inflight", numPollers, "max polls in flight at once (# of Pollers)")
+  queueWaitAlert = flag.Duration("queue-wait-alert", 5*time.Second, "alert when a resource waits longer than this for a Poller")
+  heartbeatURL = flag.String("heartbeat-url", "", "dead man's switch URL to GET while the monitor is running")
+  heartbeatInterval = flag.Duration("heartbeat-interval", time.Minute, "how often to GET -heartbeat-url (checked on each status tick)")
+  useSyslog = flag.Bool("syslog", false, "also send transitions and summaries to the local syslog")
+  dnsRetries = flag.Int("dns-retries", 2, "times a poll retries a DNS lookup that failed for a reason other than no such host")
+  timeoutPolicy = flag.String("timeout-policy", "fixed", "how repeated timeouts adapt a URL's timeout: fixed, lengthen or shorten")
+  backoffReset = flag.String("backoff-reset", "immediate", "how a healthy poll brings a failing URL's backoff down: immediate, decay (halve) or hold (one step until 3 healthy polls)")
+  syslogFacility = flag.String("syslog-facility", "daemon", "syslog facility (daemon, user, local0-local7)")
+  syslogSeverity = flag.String("syslog-severity", "down=err,reminder=err,recovered=notice,summary=info", "syslog severity (emerg to debug) of each event")
+  startupSweep = flag.Bool("startup-sweep", false, "poll every URL once at startup with -sweep-concurrency Pollers, before any -startup-jitter")
+  sweepConcurrency = flag.Int("sweep-concurrency", 4, "# of Pollers used by -startup-sweep, at most -max-inflight")
+  startupJitter = flag.Duration("startup-jitter", 0, "delay the first polls by a random time up to this, to spread out a fleet of monitors")
+  emaAlpha = flag.Float64("latency-ema-alpha", 0.3, "smoothing factor of the latency moving average, 0-1 (higher reacts faster)")
+  latencyMedian = flag.Int("latency-median", 0, "report the median of the last k latencies (up to 20) in the status log, to ignore single spikes (0 off)")
+  p90Health = flag.Duration("p90-health", 0, "a URL is only healthy while the p90 of its last 20 healthy latencies is under this, whatever single polls take (0 off)")
+  maxLatencyCV = flag.Float64("max-latency-cv", 0, "alert when the stddev/mean of a URL's recent latencies is over this (0 never)")
+  quorum = flag.String("quorum", "", "M/N: a URL is healthy while M of its last N polls were, instead of the thresholds")
+  failThreshold = flag.Int("fail-threshold", 1, "consecutive failed polls before a URL is down")
+  recoverThreshold = flag.Int("recover-threshold", 1, "consecutive healthy polls before a down URL has recovered")
+  statusMarkdown = flag.String("status-md", "", "file to write the current state to as a Markdown table on each status tick")
+  alertReminder = flag.Duration("alert-reminder", 0, "remind at this interval while a URL stays down (0 never)")
+  tlsKeyLog = flag.String("tls-keylog", "", "append TLS session keys to this file in NSS key log format (debugging only, it decrypts all captured traffic)")
+  csvDir = flag.String("csv-dir", "", "directory to append poll results to as daily CSV files")
+  csvMaxBytes = flag.Int64("csv-max-bytes", 64<<20, "roll a CSV file over once it reaches this size (0 only daily)")
+  webhookURL = flag.String("webhook-url", "", "URL to POST down, reminder and recovered events to")
+  webhookFormat = flag.String("webhook-format", "generic", "webhook payload: generic, slack or pagerduty")
+  webhookRoutingKey = flag.String("webhook-routing-key", "", "PagerDuty Events API v2 routing key, for -webhook-format pagerduty")
+  deployMarker = flag.String("deploy-marker", "", "version or deploy id to stamp poll results and events with")
+  once = flag.Bool("once", false, "poll every URL once and exit 0 if all were healthy, 1 if not")
+  manifestPath = flag.String("manifest", "", "with -once, write each URL's result and the overall pass/fail to this file as JSON")
+  logHeaders = flag.String("log-headers", "", "comma-separated response headers to log with each poll (e.g. X-Served-By,CF-Ray)")
+  redactHeaders = flag.String("redact-headers", "Authorization,Proxy-Authorization,Cookie,Set-Cookie,WWW-Authenticate", "comma-separated headers never logged, even if in -log-headers")
+  shardIndex = flag.Int("shard-index", 0, "with -shard-count, the shard of the URLs this instance polls, from 0")
+  shardCount = flag.Int("shard-count", 1, "split the URLs between this many instances by a hash of the URL")
+  enrichURL = flag.String("enrich-url", "", "endpoint to GET ?url=<url> for JSON annotations (team, runbook) to add to events")
+  enrichTTL = flag.Duration("enrich-ttl", 10*time.Minute, "how long a URL's -enrich-url annotations are cached")
+  udpCollector = flag.String("udp-collector", "", "host:port to send each poll result to as a binary UDP datagram")
+)
+
+// resources to poll
+// dependsOn names the url of another resource that must be healthy
+// for this one to be polled
+var resources = []*Resource{
+  {url: "http://www.google.com"},
+  {url: "http://golang.org"},
+  {url: "http://blog.golang.org", dependsOn: "http://golang.org"},
+}
+
+// client is shared by all Pollers
+// its session cache lets TLS handshakes to a host resume earlier sessions
+var client = &http.Client{Transport: newTransport()}
+
+// keyLog receives TLS session keys when -tls-keylog is set
+var keyLog io.Writer
+
+// openKeyLog opens the -tls-keylog file for appending
+// with no path there is no file, and no key log
+func openKeyLog(path string) (io.Writer, error) {
+  if path == "" {
+    return nil, nil
+  }
+  f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+  if err != nil {
+    return nil, err
+  }
+  log.Println("Warning: writing TLS session keys to", path, "- anyone with this file can decrypt captured traffic")
+  return f, nil
+}
+
+// newTransport returns a copy of the default transport
+// that caches TLS sessions
+func newTransport() *http.Transport {
+  t := http.DefaultTransport.(*http.Transport).Clone()
+  t.TLSClientConfig = &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(0)}
+  t.DialContext = retryDNS(t.DialContext)
+  t.TLSClientConfig.KeyLogWriter = keyLog
+  t.MaxResponseHeaderBytes = *maxHeaderBytes
+  return t
 }
 
 // STATE TYPE
@@ -34,18 +138,93 @@ var urls = []string{
 type State struct {
   url string
   status string
+  healthy bool // the poll got an answer, not a 5xx, that met its expectations
+  blocked bool // not polled because a dependency is unhealthy
+  throughput float64 // MB/s, when measured
+  tlsHost string // host of the TLS handshake, if any
+  resumed bool // whether that handshake resumed a session
+  redirects int // redirects followed by the poll
+  code int // HTTP status code, 0 without a response
+  latency time.Duration // how long the poll took
+  degraded bool // answered but fell short of an expectation
+  checked time.Time // when the poll finished
+  marker string // -deploy-marker at the time of the poll
+  annotations map[string]string // from the enricher, on events only
+}
+
+// a stateStore holds the most recent State of each URL
+// it belongs to the StateMonitor goroutine, which is the only caller
+// of its methods, everything else is handed a snapshot
+// so no other goroutine ever shares the map
+type stateStore struct {
+  m map[string]State
+}
+
+// newStateStore returns an empty store
+func newStateStore() *stateStore {
+  return &stateStore{m: make(map[string]State)}
+}
+
+// set records s as the latest State of its URL
+func (st *stateStore) set(s State) {
+  st.m[s.url] = s
+}
+
+// snapshot returns a copy of the latest States
+func (st *stateStore) snapshot() map[string]State {
+  c := make(map[string]State, len(st.m))
+  for u, s := range st.m {
+    c[u] = s
+  }
+  return c
+}
+
+// resumption counts TLS handshakes to a host
+// and how many of them resumed a session
+type resumption struct {
+  handshakes int
+  resumed int
+}
+
+// a healthQuery asks the StateMonitor whether a URL is healthy
+// the answer is sent back on reply
+type healthQuery struct {
+  url string
+  reply chan bool
 }
 
 // STATEMONITOR
 // maintains a map that sotres the state of the URLs being
 // polled, and prints the current state every updateInterval nanoseconds.
 // It returns a chan State to which resource state should be sent
-func StateMonitor(updateInterval time.Duration) chan<- State {
+// and a chan healthQuery to ask whether a URL is healthy
+// every State is also written to sink, when there is one
+// it stops once the chan State is closed
+func StateMonitor(updateInterval time.Duration, sink *csvSink) (chan<- State, chan<- healthQuery) {
   // where goroutine Poller sends State values
   updates := make(chan State)
 
-  // map of urls to most recent status
-  urlStatus := make(map[string]string)
+  // where goroutine Poller asks about the health of a dependency
+  queries := make(chan healthQuery)
+
+  // most recent state of each url
+  urlStatus := newStateStore()
+
+  // map of hosts to TLS session resumption counts
+  resumptions := make(map[string]*resumption)
+
+  // map of urls to whether they are down
+  healths := make(map[string]*health)
+
+  // map of urls to latency statistics of their healthy polls
+  latencies := make(map[string]*latencyStats)
+
+  // how often to remind about a URL that stays down
+  reminderInterval := *alertReminder
+
+  // where and how often to send the heartbeat, and when it was last sent
+  beatURL, beatInterval := *heartbeatURL, *heartbeatInterval
+  var lastBeat time.Time
 
   // object that repeatedly sends a value on a channel at specified time
   ticker := time.NewTicker(updateInterval)
@@ -57,20 +236,133 @@ func StateMonitor(updateInterval time.Duration) chan<- State {
     for {
       select {
       case <-ticker.C:
-        logState(urlStatus)
-      case s := <-updates:
-        urlStatus[s.url] = s.status
+        snap := urlStatus.snapshot()
+        logState(snap, healths, latencies, resumptions)
+        notifySummary(snap)
+        if reminderInterval > 0 {
+          for u, h := range healths {
+            if h.remind(reminderInterval) {
+              s, n, down := snap[u], h.reminders, time.Since(h.since)
+              queueEvent(func() { notifyReminder(s, n, down) })
+            }
+          }
+        }
+        if *statusMarkdown != "" {
+          if err := writeMarkdown(*statusMarkdown, snap, healths); err != nil {
+            log.Println("Error status markdown", err)
+          }
+        }
+        // only a monitor that is still ticking sends heartbeats
+        if beatURL != "" && time.Since(lastBeat) >= beatInterval {
+          lastBeat = time.Now()
+          go heartbeat(beatURL)
+        }
+      case s, ok := <-updates:
+        if !ok {
+          ticker.Stop()
+          return
+        }
+        urlStatus.set(s)
+        if sink != nil {
+          if err := sink.write(s); err != nil {
+            log.Println("Error csv", err)
+          }
+        }
+        // a blocked URL wasn't polled, so its health is unchanged
+        if !s.blocked {
+          h := healths[s.url]
+          if h == nil {
+            h = &health{}
+            healths[s.url] = h
+          }
+          if h.observe(s) {
+            if h.down {
+              queueEvent(func() { notifyDown(s) })
+            } else {
+              queueEvent(func() { notifyRecovered(s) })
+            }
+          }
+        }
+        if s.healthy {
+          l := latencies[s.url]
+          if l == nil {
+            l = &latencyStats{}
+            latencies[s.url] = l
+          }
+          l.observe(s.latency)
+          if l.checkVariance() {
+            sd, cv := l.stddev()
+            log.Printf("Alert %s latency varies: stddev %v, %.2f of the mean", s.url, sd.Round(time.Millisecond), cv)
+          }
+        }
+        if s.tlsHost != "" {
+          h := resumptions[s.tlsHost]
+          if h == nil {
+            h = &resumption{}
+            resumptions[s.tlsHost] = h
+          }
+          h.handshakes++
+          if s.resumed {
+            h.resumed++
+          }
+        }
+      case q := <-queries:
+        // a URL is unhealthy once health says it is down,
+        // so -fail-threshold and -quorum apply to dependents too
+        // one that hasn't been polled yet is not known to be unhealthy
+        h := healths[q.url]
+        q.reply <- h == nil || !h.down
       }
     }
   }()
-  return updates
+  return updates, queries
+}
+
+// heartbeat tells a dead man's switch that the monitor is alive
+// it gives up after requestTimeout, so a hung endpoint
+// can't pile up heartbeat goroutines
+func heartbeat(url string) {
+  ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+  defer cancel()
+  req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+  if err != nil {
+    log.Println("Error heartbeat", err)
+    return
+  }
+  resp, err := client.Do(req)
+  if err != nil {
+    log.Println("Error heartbeat", err)
+    return
+  }
+  resp.Body.Close()
 }
 
-// logState prints a state map
-func logState(s map[string]string) {
+// logState prints a state map with latency statistics,
+// MTTR and MTBF once a URL has had incidents
+// and the TLS session resumption ratio of each host
+func logState(s map[string]State, healths map[string]*health, latencies map[string]*latencyStats, resumptions map[string]*resumption) {
   log.Println("Current state:")
   for k, v := range s {
-    log.Printf(" %s %s", k, v)
+    line := fmt.Sprintf(" %s %s", k, v.status)
+    if l := latencies[k]; l != nil {
+      sd, _ := l.stddev()
+      line += fmt.Sprintf(" %v (ema %v, stddev %v", v.latency.Round(time.Millisecond), l.ema.Round(time.Millisecond), sd.Round(time.Millisecond))
+      if *latencyMedian > 0 {
+        line += fmt.Sprintf(", median of %d %v", *latencyMedian, l.median(*latencyMedian).Round(time.Millisecond))
+      }
+      line += ")"
+    }
+    if v.throughput > 0 {
+      line += fmt.Sprintf(" %.2f MB/s", v.throughput)
+    }
+    if h := healths[k]; h != nil && h.recoveries > 0 {
+      mttr, mtbf := h.reliability()
+      line += fmt.Sprintf(" (mttr %s, mtbf %s)", mttr, mtbf)
+    }
+    log.Print(line)
+  }
+  for host, h := range resumptions {
+    log.Printf(" %s resumed %d/%d TLS sessions", host, h.resumed, h.handshakes)
   }
 }
 
@@ -78,29 +370,410 @@ func logState(s map[string]string) {
 // A Resource represents the state of a URL to be polled
 // includes the url and number of errors since last poll
 // When program starts, allocates on Resource for each URL
+// measureThroughput opts in to a full GET download every throughputInterval
+// and an alert when it is slower than minThroughput MB/s
+// tlsServerName overrides the SNI sent and the name the cert is verified against
+// sourceIP is the local address polls of this URL are sent from
+// maxRedirects overrides the package default when set
+// expectJSON maps JSON paths to the values the body must have there
+// probeAllIPs polls every address the host resolves to as a separate backend
+// pinnedFingerprint is the hex SHA-256 of the leaf certificate or its SPKI
+// requestTimeout overrides the package default when set
+// method and body override the request sent (a body alone makes it a POST),
+// compressRequest gzips the body
+// requireSecurityHeaders lists headers the response must carry,
+// securityHeaderSet adds the usual ones (securityHeaders)
+// minCacheMaxAge is the least max-age Cache-Control must allow, maxCacheAge the oldest Age
+// expectSniffedType is the media type the body must sniff as ("image/png", "image/*")
+// closeConnection sends Connection: close so no connection outlives its poll
+// query is merged into the URL's query string
+// cacheBust adds a random _cb query parameter to every poll
+// maxLatency degrades slower polls, except within a matching latencySLA window
+// expectTrailers maps HTTP trailers to the values they must have
+// dnsServer is the host:port of the DNS server that resolves this URL
+// expectProto is the protocol the response must come over ("HTTP/2.0", "HTTP/1.1")
+// minHSTSAge audits an http:// URL: it must redirect to its https:// form,
+// which must send HSTS with at least this max-age
+// minBodyBytes and maxBodyBytes bound the size of the body, when set
+// resultWebhook is sent every poll result, at most one per resultWebhookInterval
+// dualStack polls over IPv4 and IPv6 separately and fails unless both are healthy
+// tokenURL is an OAuth2 token endpoint whose client credentials token
+// is sent as the bearer token, see token.go
+// noRedirect doesn't follow redirects and fails the poll on one
+// expectRedirects fails polls that followed a number of redirects outside it
+// ocspStapling checks the stapled OCSP response: "warn" degrades the URL
+// when it is missing, revoked or stale, "fail" fails the poll
+// expectPoP degrades the URL when the CDN PoP header (popHeader, or the first
+// of popHeaders the response has) doesn't match it
+// secureCookies degrades the URL when a cookie it sets lacks Secure, HttpOnly or SameSite
 type Resource struct {
   url string
   errCount int
+  backoff int // steps of errTimeout added to the poll interval
+  successes int // healthy polls in a row
+  dependsOn string
+  measureThroughput bool
+  minThroughput float64
+  lastDownload time.Time
+  throughput float64
+  tlsHost string
+  resumed bool
+  code int
+  tlsServerName string
+  sourceIP string
+  maxRedirects int
+  redirects int
+  expectJSON map[string]string
+  probeAllIPs bool
+  pinIP string
+  backends map[string]*Resource
+  backendStates []State
+  pinnedFingerprint string
+  reconnect bool
+  queued time.Time
+  requestTimeout time.Duration
+  timeouts int
+  method string
+  body string
+  compressRequest bool
+  requireSecurityHeaders []string
+  securityHeaderSet bool
+  minCacheMaxAge time.Duration
+  maxCacheAge time.Duration
+  expectSniffedType string
+  closeConnection bool
+  query map[string]string
+  cacheBust bool
+  maxLatency time.Duration
+  latencySLA []slaWindow
+  expectTrailers map[string]string
+  dnsServer string
+  expectProto string
+  minHSTSAge time.Duration
+  minBodyBytes int64
+  maxBodyBytes int64
+  resultWebhook string
+  resultWebhookInterval time.Duration
+  lastResultPost time.Time
+  dualStack bool
+  network string // "tcp4" or "tcp6" to dial only that family
+  tokenURL string
+  tokenClientID string
+  tokenClientSecret string
+  tokens *tokenManager
+  noRedirect bool
+  expectRedirects *countRange
+  pollLatencies latencyStats // healthy latencies, for -p90-health
+  ocspStapling string
+  expectPoP *regexp.Regexp
+  popHeader string
+  secureCookies bool
+  started time.Time
+  degraded bool
+  client *http.Client
 }
 
 // RESOURCE'S METHODS
 // performs HTTP HEAD request for Resource's URL
+// (GET when the body has expectations to meet)
 // and returns HTTP response status
 func (r *Resource) Poll() string {
-  resp, err := http.Head(r.url)
+  r.started = time.Now()
+  if r.probeAllIPs {
+    return r.pollAllIPs()
+  }
+  if r.dualStack {
+    return r.pollDualStack()
+  }
+  if r.measureThroughput && time.Since(r.lastDownload) >= throughputInterval {
+    return r.download()
+  }
+  c, err := r.httpClient()
   if err != nil {
-    log.Println("Error", r.url, err)
-    r.errCount++
-    return err.Error()
+    return r.fail(err)
+  }
+  if r.noRedirect {
+    // the first response is the one to check
+    nc := *c
+    nc.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+    c = &nc
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), r.timeout())
+  defer cancel()
+  req, err := r.newRequest(ctx, "")
+  if err != nil {
+    return r.fail(err)
+  }
+  resp, err := c.Do(req)
+  if err != nil {
+    return r.fail(err)
+  }
+  defer resp.Body.Close()
+  logPollHeaders(r.url, resp)
+  if err := checkProto(resp, r.expectProto); err != nil {
+    return r.fail(err)
+  }
+  if r.noRedirect {
+    if err := checkNoRedirect(resp); err != nil {
+      return r.fail(err)
+    }
+  }
+  if r.ocspStapling == "fail" {
+    if err := checkOCSP(resp.TLS); err != nil {
+      return r.fail(err)
+    }
+  }
+  if r.expectRedirects != nil {
+    if n := redirectCount(resp); !r.expectRedirects.contains(n) {
+      return r.fail(fmt.Errorf("expectRedirects: followed %d, want %v", n, r.expectRedirects))
+    }
+  }
+  if r.minHSTSAge > 0 {
+    if err := checkHSTS(resp, r.minHSTSAge); err != nil {
+      return r.fail(err)
+    }
+  }
+  if r.needsBody() {
+    body, err := io.ReadAll(io.LimitReader(resp.Body, r.readLimit()))
+    if err != nil {
+      return r.fail(err)
+    }
+    if err := r.checkBody(body); err != nil {
+      return r.fail(err)
+    }
+    if len(r.expectTrailers) > 0 {
+      // trailers arrive after the last byte of the body
+      if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+        return r.fail(err)
+      }
+      if err := checkTrailers(resp.Trailer, r.expectTrailers); err != nil {
+        return r.fail(err)
+      }
+    }
+  }
+  return r.succeed(resp)
+}
+
+// download performs HTTP GET request for Resource's URL, built like a poll's,
+// reads up to throughputCap bytes of the body and records the throughput
+func (r *Resource) download() string {
+  r.lastDownload = time.Now()
+  c, err := r.httpClient()
+  if err != nil {
+    return r.fail(err)
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), downloadTimeout)
+  defer cancel()
+  req, err := r.newRequest(ctx, http.MethodGet)
+  if err != nil {
+    return r.fail(err)
+  }
+  start := time.Now()
+  resp, err := c.Do(req)
+  if err != nil {
+    return r.fail(err)
+  }
+  defer resp.Body.Close()
+  n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, throughputCap))
+  if err != nil {
+    return r.fail(err)
+  }
+  r.throughput = float64(n) / 1e6 / time.Since(start).Seconds()
+  if r.throughput < r.minThroughput {
+    log.Printf("Alert %s throughput %.2f MB/s below %.2f MB/s", r.url, r.throughput, r.minThroughput)
+  }
+  return r.succeed(resp)
+}
+
+// recordSuccess clears what failed and earlier polls left behind
+// every healthy poll goes through it
+func (r *Resource) recordSuccess() {
+  r.errCount, r.timeouts = 0, 0
+  r.resetBackoff()
+  r.degraded = false
+  r.code, r.redirects = 0, 0
+}
+
+// succeed records a successful poll and returns the status
+// the TLS handshake, if the poll did one, was recorded by gotConn
+func (r *Resource) succeed(resp *http.Response) string {
+  // a server error is an answer, but not a healthy one
+  if resp.StatusCode >= 500 {
+    r.fail(errors.New(resp.Status))
+    r.code = resp.StatusCode
+    return resp.Status
+  }
+  r.recordSuccess()
+  r.code = resp.StatusCode
+  r.redirects = redirectCount(resp)
+  limit := maxRedirects
+  if r.maxRedirects > 0 {
+    limit = r.maxRedirects
+  }
+  // a degraded URL answered but falls short of some expectation
+  issues := r.checkHeaders(resp)
+  if r.redirects > limit {
+    issues = append(issues, fmt.Sprintf("%d redirects", r.redirects))
+  }
+  if r.ocspStapling == "warn" {
+    if err := checkOCSP(resp.TLS); err != nil {
+      issues = append(issues, err.Error())
+    }
+  }
+  if max := r.latencyLimit(r.started); max > 0 {
+    if d := time.Since(r.started); d > max {
+      issues = append(issues, fmt.Sprintf("latency %v over %v", d.Round(time.Millisecond), max))
+    }
+  }
+  if len(issues) > 0 {
+    r.degraded = true
+    log.Printf("Alert %s degraded: %s", r.url, strings.Join(issues, "; "))
+    return fmt.Sprintf("%s DEGRADED (%s)", resp.Status, strings.Join(issues, "; "))
   }
-  r.errCount = 0
   return resp.Status
 }
 
+// httpClient returns the client used to poll r
+// a Resource that overrides transport settings gets a client of its own
+func (r *Resource) httpClient() (*http.Client, error) {
+  if r.client != nil {
+    return r.client, nil
+  }
+  if r.tlsServerName == "" && r.sourceIP == "" && r.pinIP == "" && r.pinnedFingerprint == "" && r.dnsServer == "" && r.network == "" {
+    return client, nil
+  }
+  t := newTransport()
+  t.TLSClientConfig.ServerName = r.tlsServerName
+  if r.pinnedFingerprint != "" {
+    t.TLSClientConfig.VerifyConnection = r.verifyPin
+  }
+  if r.sourceIP != "" || r.dnsServer != "" {
+    d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+    if r.sourceIP != "" {
+      ip := net.ParseIP(r.sourceIP)
+      if ip == nil {
+        return nil, fmt.Errorf("invalid sourceIP %q", r.sourceIP)
+      }
+      d.LocalAddr = &net.TCPAddr{IP: ip}
+    }
+    res, err := r.resolver()
+    if err != nil {
+      return nil, err
+    }
+    d.Resolver = res
+    t.DialContext = retryDNS(d.DialContext)
+  }
+  if r.pinIP != "" {
+    // dial the pinned address whatever the host resolves to
+    dial := t.DialContext
+    t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+      _, port, err := net.SplitHostPort(addr)
+      if err != nil {
+        return nil, err
+      }
+      return dial(ctx, network, net.JoinHostPort(r.pinIP, port))
+    }
+  }
+  if r.network != "" {
+    // resolve and dial only addresses of one family
+    dial := t.DialContext
+    t.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+      return dial(ctx, r.network, addr)
+    }
+  }
+  r.client = &http.Client{Transport: t}
+  return r.client, nil
+}
+
+// resolver returns the resolver for r's host
+// the system's, or one that asks only r.dnsServer
+func (r *Resource) resolver() (*net.Resolver, error) {
+  if r.dnsServer == "" {
+    return net.DefaultResolver, nil
+  }
+  server := r.dnsServer
+  if _, _, err := net.SplitHostPort(server); err != nil {
+    server = net.JoinHostPort(server, "53")
+  }
+  if _, _, err := net.SplitHostPort(server); err != nil {
+    return nil, fmt.Errorf("invalid dnsServer %q", r.dnsServer)
+  }
+  return &net.Resolver{
+    PreferGo: true,
+    Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+      var d net.Dialer
+      return d.DialContext(ctx, network, server)
+    },
+  }, nil
+}
+
+// retryDNS wraps dial to retry lookups that fail transiently
+// so a resolver glitch doesn't count against the URL
+// a host that doesn't exist fails straight away
+func retryDNS(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+  return func(ctx context.Context, network, addr string) (net.Conn, error) {
+    for i := 0; ; i++ {
+      c, err := dial(ctx, network, addr)
+      var dnsErr *net.DNSError
+      if err == nil || i >= *dnsRetries || !errors.As(err, &dnsErr) || dnsErr.IsNotFound {
+        return c, err
+      }
+      select {
+      case <-ctx.Done():
+        return nil, err
+      case <-time.After(dnsRetryDelay):
+      }
+    }
+  }
+}
+
+// errPinMismatch is returned by handshakes whose certificate
+// doesn't match the pinned fingerprint
+var errPinMismatch = errors.New("certificate fingerprint mismatch")
+
+// verifyPin checks the leaf certificate against r.pinnedFingerprint
+func (r *Resource) verifyPin(cs tls.ConnectionState) error {
+  if len(cs.PeerCertificates) == 0 {
+    return errPinMismatch
+  }
+  pin := strings.ToLower(strings.ReplaceAll(r.pinnedFingerprint, ":", ""))
+  leaf := cs.PeerCertificates[0]
+  cert, spki := sha256.Sum256(leaf.Raw), sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+  if pin != hex.EncodeToString(cert[:]) && pin != hex.EncodeToString(spki[:]) {
+    return errPinMismatch
+  }
+  return nil
+}
+
+// fail logs the error of a failed poll, counts it
+// and returns it as the status
+func (r *Resource) fail(err error) string {
+  log.Println("Error", r.url, err)
+  r.errCount++
+  r.backoff++
+  r.successes = 0
+  r.degraded = false
+  r.code, r.redirects = 0, 0
+  r.tlsHost, r.resumed = "", false
+  var op *net.OpError
+  r.reconnect = errors.As(err, &op)
+  r.countTimeout(err)
+  if errors.Is(err, errPinMismatch) {
+    log.Println("Alert", r.url, err)
+    return "CRITICAL: " + errPinMismatch.Error()
+  }
+  // the transport gives no typed error for oversized headers
+  if strings.Contains(err.Error(), "server response headers exceeded") {
+    return fmt.Sprintf("HEADERS TOO LARGE (over %d bytes)", *maxHeaderBytes)
+  }
+  return err.Error()
+}
+
 // Sleep sleeps for an interval
 // before sending the Resource to done
 func (r *Resource) Sleep(done chan<- *Resource) {
-  time.Sleep(pollInterval + errTimeout*time.Duration(r.errCount))
+  time.Sleep(r.interval())
+  r.queued = time.Now()
   done <- r
 }
 
@@ -109,39 +782,235 @@ func (r *Resource) Sleep(done chan<- *Resource) {
 // Passes ownership of underlying data from sender to receiver (don't have to worry about locking)
 // Sends State value to status channel to inform StateMonitor result of Poll
 // Finally sends Resource to out channel and "returns ownership" to main goroutine
-func Poller(in <-chan *Resource, out chan<- *Resource, status chan<- State){
+// A Resource whose dependency is unhealthy is not polled, it is reported BLOCKED
+func Poller(in <-chan *Resource, out chan<- *Resource, status chan<- State, health chan<- healthQuery){
   for r := range in {
+    // a long wait for a Poller means the pool can't keep up
+    if wait := time.Since(r.queued); wait > *queueWaitAlert {
+      log.Printf("Alert %s waited %v for a Poller", r.url, wait.Round(time.Millisecond))
+    }
+    if r.dependsOn != "" {
+      reply := make(chan bool)
+      health <- healthQuery{r.dependsOn, reply}
+      if !<-reply {
+        st := State{url: r.url, status: "BLOCKED (" + r.dependsOn + " unhealthy)", blocked: true, checked: time.Now(), marker: *deployMarker}
+        sendResult(st)
+        status <- st
+        out <- r
+        continue
+      }
+    }
+    start := time.Now()
     s := r.Poll()
-    status <- State{r.url, s}
+    st := State{url: r.url, status: s, healthy: r.errCount == 0,
+      throughput: r.throughput, tlsHost: r.tlsHost, resumed: r.resumed, redirects: r.redirects,
+      code: r.code, latency: time.Since(start), degraded: r.degraded, checked: time.Now(), marker: *deployMarker}
+    r.checkP90(&st)
+    sendResult(st)
+    r.postResult(st)
+    status <- st
+    for _, b := range r.backendStates {
+      status <- b
+    }
     out <- r
   }
 }
 
+// sweep polls every resource once through a pool of its own Pollers
+// so each URL has a state as soon as possible after startup
+// it returns once all of them have been polled
+// the pool is no bigger than -max-inflight, which caps sweeps too
+func sweep(rs []*Resource, status chan<- State, health chan<- healthQuery) {
+  start := time.Now()
+  in, out := make(chan *Resource), make(chan *Resource)
+  for i := 0; i < min(*sweepConcurrency, *maxInflight); i++ {
+    go Poller(in, out, status, health)
+  }
+  go func() {
+    for _, r := range rs {
+      r.queued = time.Now()
+      in <- r
+    }
+    close(in)
+  }()
+  for range rs {
+    <-out
+  }
+  log.Printf("Startup sweep of %d URLs took %v", len(rs), time.Since(start).Round(time.Millisecond))
+}
+
+// checkURLs decides what to do with nothing to poll
+// keep running and say so, or give up with -require-urls
+func checkURLs(rs []*Resource) error {
+  if len(rs) > 0 {
+    return nil
+  }
+  if *requireURLs {
+    return errors.New("no URLs to poll")
+  }
+  log.Println("Warning: no URLs to poll")
+  return nil
+}
+
+// orderDependencies returns rs with every resource after the one it depends on
+// it makes sure every url is listed once, every dependsOn names a known resource
+// and that no resource depends on itself, directly or through others
+func orderDependencies(rs []*Resource) ([]*Resource, error) {
+  byURL := make(map[string]*Resource)
+  for _, r := range rs {
+    if byURL[r.url] != nil {
+      return nil, fmt.Errorf("%s is listed twice", r.url)
+    }
+    byURL[r.url] = r
+  }
+  ordered := make([]*Resource, 0, len(rs))
+  done := make(map[string]bool)
+  for _, r := range rs {
+    // walk up to the first dependency already ordered
+    // then order the chain from the top down
+    var chain []*Resource
+    seen := make(map[string]bool)
+    for d := r; d != nil && !done[d.url]; {
+      if seen[d.url] {
+        return nil, fmt.Errorf("dependency cycle through %s", r.url)
+      }
+      seen[d.url] = true
+      chain = append(chain, d)
+      if d.dependsOn == "" {
+        break
+      }
+      next := byURL[d.dependsOn]
+      if next == nil {
+        return nil, fmt.Errorf("%s depends on unknown url %s", d.url, d.dependsOn)
+      }
+      d = next
+    }
+    for i := len(chain) - 1; i >= 0; i-- {
+      done[chain[i].url] = true
+      ordered = append(ordered, chain[i])
+    }
+  }
+  return ordered, nil
+}
+
 // MAIN FUNCTION
 // starts Poller and StateMonitor goroutines
 // passes completed resources back to pending channel
 // after appropriate delays
 func main() {
+  // `check url` probes once as a Nagios plugin instead of monitoring
+  runCheck()
+  flag.Parse()
+  w, err := openKeyLog(*tlsKeyLog)
+  if err != nil {
+    log.Fatal(err)
+  }
+  keyLog = w
+  // transport settings come from flags
+  client = &http.Client{Transport: newTransport()}
+  if *timeoutPolicy != "fixed" && *timeoutPolicy != "lengthen" && *timeoutPolicy != "shorten" {
+    log.Fatalf("unknown -timeout-policy %q", *timeoutPolicy)
+  }
+  // without a Poller nothing is ever polled
+  if *maxInflight < 1 {
+    log.Fatalf("invalid -max-inflight %d, want at least 1", *maxInflight)
+  }
+  if *sweepConcurrency < 1 {
+    log.Fatalf("invalid -sweep-concurrency %d, want at least 1", *sweepConcurrency)
+  }
+  if *emaAlpha <= 0 || *emaAlpha > 1 {
+    log.Fatalf("invalid -latency-ema-alpha %v, want 0 < alpha <= 1", *emaAlpha)
+  }
+  if *udpCollector != "" {
+    if err := openCollector(*udpCollector); err != nil {
+      log.Fatal(err)
+    }
+  }
+  if *backoffReset != "immediate" && *backoffReset != "decay" && *backoffReset != "hold" {
+    log.Fatalf("unknown -backoff-reset %q", *backoffReset)
+  }
+  if *webhookFormat != "generic" && *webhookFormat != "slack" && *webhookFormat != "pagerduty" {
+    log.Fatalf("unknown -webhook-format %q", *webhookFormat)
+  }
+  sampledHeaders = headerList(*logHeaders, headerList(*redactHeaders, nil))
+  if *enrichURL != "" {
+    enricher = newCachingEnricher(&httpEnricher{*enrichURL}, *enrichTTL)
+    startEvents()
+  }
+  if *quorum != "" {
+    if _, err := fmt.Sscanf(*quorum, "%d/%d", &quorumM, &quorumN); err != nil || quorumM < 1 || quorumM > quorumN {
+      log.Fatalf("invalid -quorum %q, want M/N with 1 <= M <= N", *quorum)
+    }
+  }
+  if *useSyslog {
+    if err := openSyslog(*syslogFacility, *syslogSeverity); err != nil {
+      log.Println("Warning: not using syslog:", err)
+    }
+  }
+
+  if err := checkURLs(resources); err != nil {
+    log.Fatal(err)
+  }
+
+  // refuse to start with dependencies that can never be satisfied
+  // and poll dependencies before the resources that depend on them
+  ordered, err := orderDependencies(resources)
+  if err != nil {
+    log.Fatal(err)
+  }
+  if *shardCount < 1 || *shardIndex < 0 || *shardIndex >= *shardCount {
+    log.Fatalf("invalid -shard-index %d of -shard-count %d", *shardIndex, *shardCount)
+  }
+  if *shardCount > 1 {
+    ordered = shard(ordered, *shardIndex, *shardCount)
+    log.Printf("Shard %d of %d: polling %d of %d URLs", *shardIndex, *shardCount, len(ordered), len(resources))
+  }
+  startTokens(ordered)
+  if *once {
+    os.Exit(runOnce(ordered))
+  }
+
   // ceate input and output channels
   pending, complete := make(chan *Resource), make(chan *Resource)
 
   // launch StateMonitor
   // goroutine that stores the state of each Resource
-  status := StateMonitor(statusInterval)
+  var sink *csvSink
+  if *csvDir != "" {
+    if sink, err = newCSVSink(*csvDir, *csvMaxBytes); err != nil {
+      log.Fatal(err)
+    }
+  }
+  status, health := StateMonitor(statusInterval, sink)
 
   // launch some Poller goroutines
   // channels allow main, Poller, and StateMonitor to communicate
-  for i := 0; i < numPollers; i++ {
-    go Poller(pending, complete, status)
+  // the number of Pollers caps the polls in flight
+  for i := 0; i < *maxInflight; i++ {
+    go Poller(pending, complete, status, health)
   }
 
   // send some Resources to pending queue
-  // take urls and pass info as Resource to pending channel
+  // pass each Resource to pending channel
   // have to create another goroutine because channels send and receive synchronously
   // meaning send would be blocked until Poller was done
   go func() {
-    for _, url := range urls {
-      pending <- &Resource{url: url}
+    if *startupSweep {
+      sweep(ordered, status, health)
+    }
+    if *startupJitter > 0 {
+      d := rand.N(*startupJitter)
+      log.Printf("Delaying first polls by %v", d.Round(time.Millisecond))
+      time.Sleep(d)
+    }
+    for _, r := range ordered {
+      // swept resources have had their first poll, they go straight to Sleep
+      if *startupSweep {
+        complete <- r
+        continue
+      }
+      r.queued = time.Now()
+      pending <- r
     }
   }()
 
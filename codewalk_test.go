@@ -0,0 +1,751 @@
+package main
+
+import (
+  "context"
+  "crypto/sha256"
+  "crypto/x509"
+  "encoding/hex"
+  "fmt"
+  "io"
+  "log"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "regexp"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+// tlsServer starts a TLS test server and points the shared client at it
+func tlsServer(t *testing.T, h http.Handler) *httptest.Server {
+  t.Helper()
+  ts := httptest.NewTLSServer(h)
+  t.Cleanup(ts.Close)
+  pool := x509.NewCertPool()
+  pool.AddCert(ts.Certificate())
+  tr := newTransport()
+  tr.TLSClientConfig.RootCAs = pool
+  saved := client
+  client = &http.Client{Transport: tr}
+  t.Cleanup(func() { client = saved })
+  return ts
+}
+
+func TestResumption(t *testing.T) {
+  ts := tlsServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+  // each poll closes its connection, so each does a handshake
+  r := &Resource{url: ts.URL, closeConnection: true}
+  r.Poll()
+  if r.tlsHost == "" || r.resumed {
+    t.Fatalf("first poll: tlsHost %q resumed %v, want a full handshake", r.tlsHost, r.resumed)
+  }
+  r.Poll()
+  if r.tlsHost == "" || !r.resumed {
+    t.Fatalf("second poll: tlsHost %q resumed %v, want a resumption", r.tlsHost, r.resumed)
+  }
+
+  // a poll over a kept-alive connection did no handshake
+  k := &Resource{url: ts.URL}
+  k.Poll()
+  if k.tlsHost == "" {
+    t.Fatal("first keep-alive poll: no handshake recorded")
+  }
+  k.Poll()
+  if k.tlsHost != "" {
+    t.Fatalf("reused connection: tlsHost %q, want no handshake", k.tlsHost)
+  }
+}
+
+func TestDownloadRequest(t *testing.T) {
+  var got *http.Request
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    got = r
+  }))
+  defer ts.Close()
+
+  // a download is a GET with the poll's query and cache buster, even for a POST
+  r := &Resource{url: ts.URL + "/?a=1", method: http.MethodPost, body: "x",
+    query: map[string]string{"b": "2"}, cacheBust: true}
+  if s := r.download(); s != "200 OK" {
+    t.Fatalf("download: %s", s)
+  }
+  q := got.URL.Query()
+  if got.Method != http.MethodGet || q.Get("a") != "1" || q.Get("b") != "2" || q.Get("_cb") == "" {
+    t.Fatalf("download sent %s %s", got.Method, got.URL)
+  }
+  if got.ContentLength != 0 {
+    t.Fatalf("download sent a %d byte body", got.ContentLength)
+  }
+}
+
+// TestStateMonitorStress streams updates and health queries
+// into a StateMonitor that snapshots its states every millisecond
+// it is meant for go test -race, which fails it on any shared access
+func TestStateMonitorStress(t *testing.T) {
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+  updates, queries := StateMonitor(time.Millisecond, nil)
+
+  var wg sync.WaitGroup
+  for w := 0; w < 8; w++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for i := 0; i < 500; i++ {
+        updates <- State{url: fmt.Sprint("u", i%16), healthy: i%3 != 0, latency: time.Duration(i) * time.Millisecond, checked: time.Now()}
+      }
+    }()
+  }
+  for q := 0; q < 4; q++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for i := 0; i < 500; i++ {
+        reply := make(chan bool)
+        queries <- healthQuery{fmt.Sprint("u", i%16), reply}
+        <-reply
+      }
+    }()
+  }
+  wg.Wait()
+  // let a few more ticks snapshot the final states
+  time.Sleep(10 * time.Millisecond)
+  close(updates)
+}
+
+func TestSweep(t *testing.T) {
+  savedSweep, savedInflight := *sweepConcurrency, *maxInflight
+  *sweepConcurrency, *maxInflight = 4, 2
+  t.Cleanup(func() { *sweepConcurrency, *maxInflight = savedSweep, savedInflight })
+  var mu sync.Mutex
+  inflight, most := 0, 0
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    mu.Lock()
+    inflight++
+    most = max(most, inflight)
+    mu.Unlock()
+    time.Sleep(20 * time.Millisecond)
+    mu.Lock()
+    inflight--
+    mu.Unlock()
+  }))
+  defer ts.Close()
+
+  var rs []*Resource
+  for i := 0; i < 6; i++ {
+    rs = append(rs, &Resource{url: fmt.Sprintf("%s/%d", ts.URL, i)})
+  }
+  status := make(chan State, len(rs))
+  sweep(rs, status, nil)
+  // every URL has a state by the time the sweep returns
+  close(status)
+  seen := make(map[string]bool)
+  for s := range status {
+    seen[s.url] = true
+  }
+  for _, r := range rs {
+    if !seen[r.url] {
+      t.Errorf("no state for %s after the sweep", r.url)
+    }
+  }
+  if most > 2 {
+    t.Fatalf("%d polls in flight during the sweep, want at most -max-inflight 2", most)
+  }
+}
+
+func TestOrderDependencies(t *testing.T) {
+  // d needs b, which like c needs a
+  rs := []*Resource{
+    {url: "d", dependsOn: "b"},
+    {url: "c", dependsOn: "a"},
+    {url: "b", dependsOn: "a"},
+    {url: "a"},
+    {url: "e"},
+  }
+  ordered, err := orderDependencies(rs)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(ordered) != len(rs) {
+    t.Fatalf("%d resources ordered, want %d", len(ordered), len(rs))
+  }
+  at := make(map[string]int)
+  for i, r := range ordered {
+    at[r.url] = i
+  }
+  for _, r := range rs {
+    if _, ok := at[r.url]; !ok {
+      t.Fatalf("%s left out", r.url)
+    }
+    if r.dependsOn != "" && at[r.dependsOn] > at[r.url] {
+      t.Errorf("%s ordered before its dependency %s", r.url, r.dependsOn)
+    }
+  }
+
+  bad := map[string][]*Resource{
+    "dependency cycle": {{url: "a", dependsOn: "b"}, {url: "b", dependsOn: "c"}, {url: "c", dependsOn: "a"}},
+    "depends on unknown": {{url: "a", dependsOn: "z"}},
+    "listed twice": {{url: "a"}, {url: "b", dependsOn: "a"}, {url: "a"}},
+  }
+  for want, rs := range bad {
+    if _, err := orderDependencies(rs); err == nil || !strings.Contains(err.Error(), want) {
+      t.Errorf("error %v, want %q", err, want)
+    }
+  }
+}
+
+func TestFailover(t *testing.T) {
+  var gotClose atomic.Bool
+  old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  defer old.Close()
+  moved := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    gotClose.Store(r.Close)
+  }))
+  defer moved.Close()
+
+  // failover.test resolves to whatever addr holds
+  var addr atomic.Value
+  addr.Store(old.Listener.Addr().String())
+  var d net.Dialer
+  tr := &http.Transport{DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+    return d.DialContext(ctx, network, addr.Load().(string))
+  }}
+  defer tr.CloseIdleConnections()
+  r := &Resource{url: "http://failover.test/", client: &http.Client{Transport: tr}}
+
+  r.Poll()
+  if r.errCount != 0 {
+    t.Fatal("first poll failed")
+  }
+  // the old address goes down before DNS moves the name
+  old.CloseClientConnections()
+  addr.Store("127.0.0.1:1")
+  r.Poll()
+  if r.errCount == 0 || !r.reconnect {
+    t.Fatalf("poll of the downed address: errCount %d reconnect %v", r.errCount, r.reconnect)
+  }
+  addr.Store(moved.Listener.Addr().String())
+  if s := r.Poll(); s != "200 OK" {
+    t.Fatalf("poll after the failover: %s", s)
+  }
+  if !gotClose.Load() {
+    t.Fatal("the poll after a connection failure kept its connection alive")
+  }
+  r.Poll()
+  if gotClose.Load() {
+    t.Fatal("polls after recovering still close their connections")
+  }
+}
+
+func TestThroughput(t *testing.T) {
+  // a 1 MiB body sent in four chunks 50ms apart takes at least 150ms
+  const size = 1 << 20
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+      return
+    }
+    w.Header().Set("Content-Length", fmt.Sprint(size))
+    chunk := make([]byte, size/4)
+    for i := 0; i < 4; i++ {
+      if i > 0 {
+        time.Sleep(50 * time.Millisecond)
+      }
+      w.Write(chunk)
+      w.(http.Flusher).Flush()
+    }
+  }))
+  defer ts.Close()
+  var logs strings.Builder
+  log.SetOutput(&logs)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  r := &Resource{url: ts.URL, measureThroughput: true, minThroughput: 1000}
+  if s := r.Poll(); s != "200 OK" {
+    t.Fatalf("download: %s", s)
+  }
+  // 1.05 MB over 150ms to 600ms
+  if r.throughput < 1.7 || r.throughput > 7 {
+    t.Fatalf("throughput %.2f MB/s, want about %.2f", r.throughput, size/1e6/0.15)
+  }
+  if !strings.Contains(logs.String(), "Alert "+ts.URL+" throughput") {
+    t.Fatalf("no alert for throughput under minThroughput, logged %q", logs.String())
+  }
+
+  // the next download waits for throughputInterval, polls in between are HEADs
+  last := r.lastDownload
+  r.Poll()
+  if r.lastDownload != last {
+    t.Fatal("downloaded again within throughputInterval")
+  }
+}
+
+func TestTLSServerName(t *testing.T) {
+  var sni atomic.Value
+  ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    sni.Store(r.TLS.ServerName)
+  }))
+  defer ts.Close()
+  pool := x509.NewCertPool()
+  pool.AddCert(ts.Certificate())
+  // the test cert is for example.com, not localhost
+  url := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+  trust := func(r *Resource) {
+    c, err := r.httpClient()
+    if err != nil {
+      t.Fatal(err)
+    }
+    c.Transport.(*http.Transport).TLSClientConfig.RootCAs = pool
+  }
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  // sourceIP gives the resource a client of its own to trust the cert in
+  plain := &Resource{url: url, sourceIP: "127.0.0.1"}
+  trust(plain)
+  if s := plain.Poll(); !strings.Contains(s, "certificate") {
+    t.Fatalf("poll without tlsServerName: %s, want a certificate error", s)
+  }
+
+  r := &Resource{url: url, tlsServerName: "example.com"}
+  trust(r)
+  if s := r.Poll(); s != "200 OK" {
+    t.Fatalf("poll with tlsServerName: %s", s)
+  }
+  if got := sni.Load(); got != "example.com" {
+    t.Fatalf("server saw SNI %v, want example.com", got)
+  }
+}
+
+func TestSourceIP(t *testing.T) {
+  // all of 127/8 is loopback on Linux, elsewhere 127.0.0.2 may not exist
+  if l, err := net.Listen("tcp", "127.0.0.2:0"); err != nil {
+    t.Skip("no 127.0.0.2 to bind to:", err)
+  } else {
+    l.Close()
+  }
+  var from atomic.Value
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    from.Store(r.RemoteAddr)
+  }))
+  defer ts.Close()
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  r := &Resource{url: ts.URL, sourceIP: "127.0.0.2"}
+  if s := r.Poll(); s != "200 OK" {
+    t.Fatalf("poll from 127.0.0.2: %s", s)
+  }
+  if host, _, _ := net.SplitHostPort(from.Load().(string)); host != "127.0.0.2" {
+    t.Fatalf("connection came from %s, want 127.0.0.2", host)
+  }
+
+  bad := map[string]string{
+    "not-an-ip": `invalid sourceIP "not-an-ip"`,
+    "192.0.2.1": "192.0.2.1", // TEST-NET-1, not an address of this host
+  }
+  for ip, want := range bad {
+    b := &Resource{url: ts.URL, sourceIP: ip}
+    if s := b.Poll(); b.errCount == 0 || !strings.Contains(s, want) {
+      t.Errorf("poll from %s: %s, want a failure mentioning %q", ip, s, want)
+    }
+  }
+}
+
+// redirectServer serves /n by redirecting to /n-1, and /0 with a 200
+func redirectServer(t *testing.T) *httptest.Server {
+  t.Helper()
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    var n int
+    fmt.Sscan(strings.TrimPrefix(r.URL.Path, "/"), &n)
+    if n > 0 {
+      http.Redirect(w, r, fmt.Sprint("/", n-1), http.StatusFound)
+    }
+  }))
+  t.Cleanup(ts.Close)
+  return ts
+}
+
+func TestRedirectCount(t *testing.T) {
+  ts := redirectServer(t)
+  var logs strings.Builder
+  log.SetOutput(&logs)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  // within the default of maxRedirects 3
+  r := &Resource{url: ts.URL + "/2"}
+  if s := r.Poll(); s != "200 OK" || r.redirects != 2 || r.degraded {
+    t.Fatalf("2 redirects: %s, %d recorded, degraded %v", s, r.redirects, r.degraded)
+  }
+
+  // over it, the URL answered but is degraded
+  r = &Resource{url: ts.URL + "/5"}
+  if s := r.Poll(); !strings.Contains(s, "DEGRADED (5 redirects)") || r.redirects != 5 || !r.degraded {
+    t.Fatalf("5 redirects: %s, %d recorded, degraded %v", s, r.redirects, r.degraded)
+  }
+  if r.errCount != 0 {
+    t.Fatal("too many redirects failed the poll, want it degraded")
+  }
+  if !strings.Contains(logs.String(), "Alert "+r.url+" degraded: 5 redirects") {
+    t.Fatalf("no alert for 5 redirects, logged %q", logs.String())
+  }
+
+  // a resource's own maxRedirects overrides the default
+  r = &Resource{url: ts.URL + "/5", maxRedirects: 6}
+  if s := r.Poll(); s != "200 OK" || r.redirects != 5 {
+    t.Fatalf("5 redirects under maxRedirects 6: %s, %d recorded", s, r.redirects)
+  }
+}
+
+func TestCheckURLs(t *testing.T) {
+  saved := *requireURLs
+  t.Cleanup(func() { *requireURLs = saved })
+  var logs strings.Builder
+  log.SetOutput(&logs)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  // by default an empty list is a warning, and the monitor runs on
+  *requireURLs = false
+  if err := checkURLs(nil); err != nil {
+    t.Fatalf("empty list: %v, want to keep running", err)
+  }
+  if !strings.Contains(logs.String(), "Warning: no URLs to poll") {
+    t.Fatalf("no warning for an empty list, logged %q", logs.String())
+  }
+
+  // -require-urls fails fast
+  *requireURLs = true
+  if err := checkURLs(nil); err == nil {
+    t.Fatal("empty list under -require-urls: no error")
+  }
+  logs.Reset()
+  if err := checkURLs([]*Resource{{url: "http://a"}}); err != nil || logs.Len() > 0 {
+    t.Fatalf("one URL under -require-urls: %v, logged %q", err, logs.String())
+  }
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("X-Big", strings.Repeat("x", 8<<10))
+  }))
+  defer ts.Close()
+  saved, savedClient := *maxHeaderBytes, client
+  t.Cleanup(func() { *maxHeaderBytes, client = saved, savedClient })
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  // the limit is set on the transport when it is built
+  *maxHeaderBytes = 4 << 10
+  client = &http.Client{Transport: newTransport()}
+  r := &Resource{url: ts.URL}
+  if s := r.Poll(); s != "HEADERS TOO LARGE (over 4096 bytes)" || r.errCount != 1 {
+    t.Fatalf("8KB header over a 4KB limit: %s, errCount %d", s, r.errCount)
+  }
+
+  *maxHeaderBytes = 16 << 10
+  client = &http.Client{Transport: newTransport()}
+  if s := r.Poll(); s != "200 OK" {
+    t.Fatalf("8KB header under a 16KB limit: %s", s)
+  }
+}
+
+func TestHeartbeat(t *testing.T) {
+  var beats atomic.Int32
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    beats.Add(1)
+  }))
+  defer ts.Close()
+  savedURL, savedInterval := *heartbeatURL, *heartbeatInterval
+  *heartbeatURL, *heartbeatInterval = ts.URL, 20*time.Millisecond
+  t.Cleanup(func() { *heartbeatURL, *heartbeatInterval = savedURL, savedInterval })
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  // ticks every 5ms send a heartbeat at most every 20ms
+  updates, _ := StateMonitor(5*time.Millisecond, nil)
+  time.Sleep(200 * time.Millisecond)
+  if n := beats.Load(); n < 3 || n > 11 {
+    t.Fatalf("%d heartbeats in 200ms, want one about every 20ms", n)
+  }
+
+  // a stopped monitor sends none
+  close(updates)
+  time.Sleep(50 * time.Millisecond)
+  n := beats.Load()
+  time.Sleep(100 * time.Millisecond)
+  if m := beats.Load(); m != n {
+    t.Fatalf("%d heartbeats after the monitor stopped", m-n)
+  }
+}
+
+func TestPinnedFingerprint(t *testing.T) {
+  ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  defer ts.Close()
+  pool := x509.NewCertPool()
+  pool.AddCert(ts.Certificate())
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+  cert := sha256.Sum256(ts.Certificate().Raw)
+  spki := sha256.Sum256(ts.Certificate().RawSubjectPublicKeyInfo)
+
+  pins := map[string]string{
+    hex.EncodeToString(cert[:]): "200 OK",
+    hex.EncodeToString(spki[:]): "200 OK",
+    // as fingerprints are often written, AB:CD:...
+    strings.ToUpper(strings.ReplaceAll(fmt.Sprintf("% x", cert[:]), " ", ":")): "200 OK",
+    strings.Repeat("00", 32): "CRITICAL: certificate fingerprint mismatch",
+  }
+  for pin, want := range pins {
+    r := &Resource{url: ts.URL, pinnedFingerprint: pin}
+    c, err := r.httpClient()
+    if err != nil {
+      t.Fatal(err)
+    }
+    c.Transport.(*http.Transport).TLSClientConfig.RootCAs = pool
+    if s := r.Poll(); s != want {
+      t.Errorf("pin %s: %s, want %s", pin, s, want)
+    }
+  }
+}
+
+func TestStalledHead(t *testing.T) {
+  released := make(chan struct{})
+  freed := make(chan string, 2)
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    // /hang never answers, / answers a HEAD and then holds on as if a body were due
+    if r.URL.Path != "/hang" {
+      w.Header().Set("Content-Length", "1000")
+      w.WriteHeader(http.StatusOK)
+      w.(http.Flusher).Flush()
+    }
+    select {
+    case <-r.Context().Done():
+      freed <- r.URL.Path
+    case <-released:
+    }
+  }))
+  defer ts.Close()
+  defer close(released)
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  // the poll is done with the headers and drops the connection
+  r := &Resource{url: ts.URL, closeConnection: true, requestTimeout: 300 * time.Millisecond}
+  start := time.Now()
+  if s := r.Poll(); s != "200 OK" {
+    t.Fatalf("stalled HEAD: %s", s)
+  }
+  if d := time.Since(start); d > 300*time.Millisecond {
+    t.Fatalf("stalled HEAD took %v, want it back before the 300ms timeout", d)
+  }
+  select {
+  case <-freed:
+  case <-time.After(time.Second):
+    t.Fatal("the stalled HEAD's connection was never closed")
+  }
+
+  // one that never answers is given up on at the timeout
+  h := &Resource{url: ts.URL + "/hang", requestTimeout: 300 * time.Millisecond}
+  start = time.Now()
+  h.Poll()
+  if d := time.Since(start); h.errCount != 1 || d > time.Second {
+    t.Fatalf("hanging HEAD: errCount %d after %v, want a failure at the 300ms timeout", h.errCount, d)
+  }
+  select {
+  case <-freed:
+  case <-time.After(time.Second):
+    t.Fatal("the hanging HEAD's connection was never closed")
+  }
+}
+
+func TestKeyLog(t *testing.T) {
+  dir := t.TempDir()
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+  saved := keyLog
+  t.Cleanup(func() { keyLog = saved })
+
+  // without -tls-keylog nothing is written anywhere
+  w, err := openKeyLog("")
+  if w != nil || err != nil {
+    t.Fatalf("no path: key log %v, error %v", w, err)
+  }
+  keyLog = w
+  ts := tlsServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  if s := (&Resource{url: ts.URL}).Poll(); s != "200 OK" {
+    t.Fatalf("poll without a key log: %s", s)
+  }
+  if files, _ := os.ReadDir(dir); len(files) > 0 {
+    t.Fatalf("%d files written without a key log", len(files))
+  }
+
+  path := filepath.Join(dir, "keys.log")
+  w, err = openKeyLog(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { w.(io.Closer).Close() })
+  keyLog = w
+  ts = tlsServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  if s := (&Resource{url: ts.URL}).Poll(); s != "200 OK" {
+    t.Fatalf("poll with a key log: %s", s)
+  }
+  b, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // NSS format: label, client random and secret, both in hex
+  line := regexp.MustCompile(`^(CLIENT_RANDOM|[A-Z_]+_TRAFFIC_SECRET_0|[A-Z_]+_HANDSHAKE_TRAFFIC_SECRET) [0-9a-f]{64} [0-9a-f]+$`)
+  lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+  for _, l := range lines {
+    if !line.MatchString(l) {
+      t.Fatalf("key log line %q is not in NSS key log format", l)
+    }
+  }
+  if len(lines) < 2 {
+    t.Fatalf("%d key log lines for a handshake", len(lines))
+  }
+  if fi, err := os.Stat(path); err == nil && fi.Mode().Perm() != 0600 {
+    t.Fatalf("key log mode %v, want 0600", fi.Mode().Perm())
+  }
+}
+
+func TestRetryDNS(t *testing.T) {
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  defer ts.Close()
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+  saved := *dnsRetries
+  t.Cleanup(func() { *dnsRetries = saved })
+
+  // a resolver that fails its first lookups with err, then finds the server
+  var d net.Dialer
+  flaky := func(failures int, err *net.DNSError) (*Resource, *atomic.Int32) {
+    var lookups atomic.Int32
+    dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+      if lookups.Add(1) <= int32(failures) {
+        return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+      }
+      return d.DialContext(ctx, network, ts.Listener.Addr().String())
+    }
+    tr := &http.Transport{DialContext: retryDNS(dial)}
+    t.Cleanup(tr.CloseIdleConnections)
+    return &Resource{url: "http://flaky.test/", client: &http.Client{Transport: tr}}, &lookups
+  }
+  glitch := &net.DNSError{Err: "server misbehaving", Name: "flaky.test", IsTemporary: true}
+
+  // two glitches are retried within the one poll
+  *dnsRetries = 2
+  r, lookups := flaky(2, glitch)
+  if s := r.Poll(); s != "200 OK" || r.errCount != 0 {
+    t.Fatalf("poll through 2 DNS glitches: %s, errCount %d", s, r.errCount)
+  }
+  if n := lookups.Load(); n != 3 {
+    t.Fatalf("%d lookups, want 2 failures and a success", n)
+  }
+
+  // one more than -dns-retries fails the poll
+  r, _ = flaky(3, glitch)
+  if r.Poll(); r.errCount != 1 {
+    t.Fatal("poll through 3 DNS glitches with -dns-retries 2 succeeded")
+  }
+
+  // a host that doesn't exist isn't retried
+  r, lookups = flaky(1, &net.DNSError{Err: "no such host", Name: "flaky.test", IsNotFound: true})
+  if r.Poll(); r.errCount != 1 || lookups.Load() != 1 {
+    t.Fatalf("no such host: errCount %d after %d lookups, want a failure after 1", r.errCount, lookups.Load())
+  }
+
+  *dnsRetries = 0
+  r, lookups = flaky(1, glitch)
+  if r.Poll(); r.errCount != 1 || lookups.Load() != 1 {
+    t.Fatalf("-dns-retries 0: errCount %d after %d lookups, want a failure after 1", r.errCount, lookups.Load())
+  }
+}
+
+// dnsStub answers A queries for every name with 127.0.0.1,
+// AAAA queries with ::1 and any other query with no records, over UDP
+// it sends each name asked for on the channel
+func dnsStub(t *testing.T) (string, <-chan string) {
+  t.Helper()
+  pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { pc.Close() })
+  names := make(chan string, 16)
+  go func() {
+    buf := make([]byte, 512)
+    for {
+      n, addr, err := pc.ReadFrom(buf)
+      if err != nil {
+        return
+      }
+      // header, then one question: labels up to a 0, type and class
+      q := buf[:n]
+      end := 12
+      var labels []string
+      for end < len(q) && q[end] != 0 {
+        labels = append(labels, string(q[end+1:end+1+int(q[end])]))
+        end += 1 + int(q[end])
+      }
+      end += 5
+      if end > len(q) {
+        continue
+      }
+      select {
+      case names <- strings.Join(labels, "."):
+      default:
+      }
+      resp := append([]byte{q[0], q[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}, q[12:end]...)
+      var ip net.IP
+      switch q[end-3] {
+      case 1: // A
+        ip = net.IPv4(127, 0, 0, 1).To4()
+      case 28: // AAAA
+        ip = net.IPv6loopback
+      }
+      if q[end-4] == 0 && ip != nil {
+        resp[7] = 1
+        resp = append(resp, 0xc0, 12, 0, q[end-3], 0, 1, 0, 0, 0, 60, 0, byte(len(ip)))
+        resp = append(resp, ip...)
+      }
+      pc.WriteTo(resp, addr)
+    }
+  }()
+  return pc.LocalAddr().String(), names
+}
+
+func TestDNSServer(t *testing.T) {
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  defer ts.Close()
+  _, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+  stub, names := dnsStub(t)
+
+  // only the stub knows split.test
+  r := &Resource{url: "http://split.test:" + port + "/", dnsServer: stub}
+  if s := r.Poll(); s != "200 OK" {
+    t.Fatalf("poll resolved through the stub: %s", s)
+  }
+  if got := <-names; got != "split.test" {
+    t.Fatalf("stub was asked for %q, want split.test", got)
+  }
+
+  bad := map[string]string{
+    "[::1": `invalid dnsServer "[::1"`,
+    "127.0.0.1:1": "split.test", // nothing answers there
+  }
+  for server, want := range bad {
+    b := &Resource{url: r.url, dnsServer: server}
+    if s := b.Poll(); b.errCount != 1 || !strings.Contains(s, want) {
+      t.Errorf("dnsServer %s: %s, want a failure mentioning %q", server, s, want)
+    }
+  }
+}
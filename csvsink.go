@@ -0,0 +1,106 @@
+package main
+// appending poll results to CSV files for offline analysis
+// one file per day, rolled over again when it reaches -csv-max-bytes
+
+import (
+  "encoding/csv"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strconv"
+  "time"
+)
+
+var csvHeader = []string{"time", "url", "status", "healthy", "blocked", "degraded",
+  "code", "latency_ms", "redirects", "throughput_mbps", "tls_resumed", "marker"}
+
+// a csvSink writes States to the current file in dir
+// it is only used by the StateMonitor goroutine
+type csvSink struct {
+  dir string
+  maxBytes int64
+  day string // day of the open file
+  part int // rollover number within the day
+  f *os.File
+  w *csv.Writer
+  size int64
+}
+
+// newCSVSink returns a sink writing to dir, creating it if needed
+func newCSVSink(dir string, maxBytes int64) (*csvSink, error) {
+  if err := os.MkdirAll(dir, 0755); err != nil {
+    return nil, err
+  }
+  return &csvSink{dir: dir, maxBytes: maxBytes}, nil
+}
+
+// write appends s as a row, rotating first if the day changed
+// or the file is full
+// each row is flushed, so nothing is lost when the process stops
+// a State without a check time is filed under now
+func (c *csvSink) write(s State) error {
+  if s.checked.IsZero() {
+    s.checked = time.Now()
+  }
+  day := s.checked.UTC().Format("2006-01-02")
+  if c.f == nil || day != c.day || c.maxBytes > 0 && c.size >= c.maxBytes {
+    if err := c.rotate(day); err != nil {
+      return err
+    }
+  }
+  c.w.Write([]string{
+    s.checked.UTC().Format(time.RFC3339Nano), s.url, s.status,
+    strconv.FormatBool(s.healthy), strconv.FormatBool(s.blocked), strconv.FormatBool(s.degraded),
+    strconv.Itoa(s.code), strconv.FormatFloat(float64(s.latency)/float64(time.Millisecond), 'f', 3, 64),
+    strconv.Itoa(s.redirects), strconv.FormatFloat(s.throughput, 'f', 3, 64), strconv.FormatBool(s.resumed),
+    s.marker,
+  })
+  c.w.Flush()
+  if err := c.w.Error(); err != nil {
+    return err
+  }
+  fi, err := c.f.Stat()
+  if err != nil {
+    return err
+  }
+  c.size = fi.Size()
+  return nil
+}
+
+// rotate closes the open file and opens the next one for day
+// a file kept from an earlier run is appended to, not overwritten
+func (c *csvSink) rotate(day string) error {
+  if c.f != nil {
+    c.f.Close()
+  }
+  if day != c.day {
+    c.day, c.part = day, 0
+  } else {
+    c.part++
+  }
+  for {
+    name := fmt.Sprintf("results-%s.csv", c.day)
+    if c.part > 0 {
+      name = fmt.Sprintf("results-%s.%d.csv", c.day, c.part)
+    }
+    f, err := os.OpenFile(filepath.Join(c.dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil {
+      return err
+    }
+    fi, err := f.Stat()
+    if err != nil {
+      f.Close()
+      return err
+    }
+    if c.maxBytes > 0 && fi.Size() >= c.maxBytes {
+      f.Close()
+      c.part++
+      continue
+    }
+    c.f, c.w, c.size = f, csv.NewWriter(f), fi.Size()
+    if c.size == 0 {
+      c.w.Write(csvHeader)
+    }
+    return nil
+  }
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+  "encoding/csv"
+  "os"
+  "path/filepath"
+  "sort"
+  "testing"
+  "time"
+)
+
+// readCSV returns the rows of each file in dir, by file name
+func readCSV(t *testing.T, dir string) map[string][][]string {
+  t.Helper()
+  names, err := filepath.Glob(filepath.Join(dir, "*.csv"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  files := make(map[string][][]string)
+  for _, name := range names {
+    f, err := os.Open(name)
+    if err != nil {
+      t.Fatal(err)
+    }
+    rows, err := csv.NewReader(f).ReadAll()
+    f.Close()
+    if err != nil {
+      t.Fatal(err)
+    }
+    files[filepath.Base(name)] = rows
+  }
+  return files
+}
+
+func TestCSVSinkRotation(t *testing.T) {
+  dir := t.TempDir()
+  sink, err := newCSVSink(dir, 300)
+  if err != nil {
+    t.Fatal(err)
+  }
+  day1 := time.Date(2024, 3, 1, 23, 59, 0, 0, time.UTC)
+  day2 := day1.Add(2 * time.Minute)
+  for i := 0; i < 4; i++ {
+    if err := sink.write(State{url: "http://example.com", status: "200 OK", healthy: true, code: 200,
+      latency: 12 * time.Millisecond, checked: day1}); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := sink.write(State{url: "http://example.com", status: "200 OK", checked: day2}); err != nil {
+    t.Fatal(err)
+  }
+
+  files := readCSV(t, dir)
+  var names []string
+  for name := range files {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  want := []string{"results-2024-03-01.1.csv", "results-2024-03-01.csv", "results-2024-03-02.csv"}
+  if len(names) != len(want) {
+    t.Fatalf("files %v, want %v", names, want)
+  }
+  for i := range want {
+    if names[i] != want[i] {
+      t.Fatalf("files %v, want %v", names, want)
+    }
+  }
+  rows := 0
+  for name, f := range files {
+    if len(f[0]) != len(csvHeader) || f[0][0] != "time" {
+      t.Fatalf("%s: header %v", name, f[0])
+    }
+    rows += len(f) - 1
+  }
+  if rows != 5 {
+    t.Fatalf("%d rows, want 5", rows)
+  }
+  first := files["results-2024-03-01.csv"][1]
+  if first[1] != "http://example.com" || first[6] != "200" || first[7] != "12.000" {
+    t.Fatalf("row %v", first)
+  }
+}
+
+func TestCSVSinkZeroTime(t *testing.T) {
+  dir := t.TempDir()
+  sink, err := newCSVSink(dir, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := sink.write(State{url: "http://example.com [127.0.0.1]"}); err != nil {
+    t.Fatal(err)
+  }
+  today := "results-" + time.Now().UTC().Format("2006-01-02") + ".csv"
+  files := readCSV(t, dir)
+  if _, ok := files[today]; !ok || len(files) != 1 {
+    t.Fatalf("files %v, want only %s", files, today)
+  }
+}
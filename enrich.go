@@ -0,0 +1,129 @@
+package main
+// annotating transition events with context about the URL
+// (owning team, runbook, recent deploy) from an enrichment hook
+
+import (
+  "encoding/json"
+  "fmt"
+  "log"
+  "net/http"
+  "net/url"
+  "sort"
+  "time"
+)
+
+// an Enricher returns annotations to attach to events about a URL
+type Enricher interface {
+  Enrich(url string) (map[string]string, error)
+}
+
+// enricher annotates events, if one is configured
+// it is only called from the event goroutine, see startEvents
+var enricher Enricher
+
+// events carries the events to send while an enricher is configured
+var events chan func()
+
+// startEvents starts the goroutine that sends events
+// so a slow enrichment hook holds up other events, not the StateMonitor
+// events are sent in the order they were queued
+func startEvents() {
+  events = make(chan func(), eventQueue)
+  go func() {
+    for send := range events {
+      send()
+    }
+  }()
+}
+
+// queueEvent has the event goroutine run send, if there is one
+// or runs it right away
+func queueEvent(send func()) {
+  if events == nil {
+    send()
+    return
+  }
+  events <- send
+}
+
+// enrich returns s with the enricher's annotations for its URL
+// an event goes out without context rather than not at all
+func enrich(s State) State {
+  if enricher != nil {
+    a, err := enricher.Enrich(s.url)
+    if err != nil {
+      log.Println("Error enrich", err)
+    }
+    s.annotations = a
+  }
+  return s
+}
+
+// sortedKeys returns the keys of annotations in order
+func sortedKeys(annotations map[string]string) []string {
+  keys := make([]string, 0, len(annotations))
+  for k := range annotations {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+// an httpEnricher GETs endpoint?url=<url>
+// and takes the JSON object of strings it answers as the annotations
+type httpEnricher struct {
+  endpoint string
+}
+
+// Enrich asks the endpoint about u, giving up after enrichTimeout
+func (e *httpEnricher) Enrich(u string) (map[string]string, error) {
+  c := &http.Client{Timeout: enrichTimeout}
+  resp, err := c.Get(e.endpoint + "?url=" + url.QueryEscape(u))
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return nil, fmt.Errorf("enrich endpoint: %s", resp.Status)
+  }
+  var a map[string]string
+  if err := json.NewDecoder(resp.Body).Decode(&a); err != nil {
+    return nil, fmt.Errorf("invalid response: %v", err)
+  }
+  return a, nil
+}
+
+// a cachingEnricher remembers each URL's annotations for ttl
+// so the hook isn't called for every event
+// it is not safe for concurrent use
+type cachingEnricher struct {
+  next Enricher
+  ttl time.Duration
+  cache map[string]cachedAnnotations
+}
+
+type cachedAnnotations struct {
+  annotations map[string]string
+  fetched time.Time
+}
+
+// newCachingEnricher caches the annotations of next for ttl
+func newCachingEnricher(next Enricher, ttl time.Duration) *cachingEnricher {
+  return &cachingEnricher{next: next, ttl: ttl, cache: make(map[string]cachedAnnotations)}
+}
+
+// Enrich returns the cached annotations of u until they are ttl old
+// a failed lookup isn't cached, so the next event asks again
+// until then it gets the stale annotations, if there are any
+func (e *cachingEnricher) Enrich(u string) (map[string]string, error) {
+  c, ok := e.cache[u]
+  if ok && time.Since(c.fetched) < e.ttl {
+    return c.annotations, nil
+  }
+  a, err := e.next.Enrich(u)
+  if err != nil {
+    return c.annotations, err
+  }
+  e.cache[u] = cachedAnnotations{a, time.Now()}
+  return a, nil
+}
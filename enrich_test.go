@@ -0,0 +1,105 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "log"
+  "os"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+// a fakeEnricher answers with a, or fails while err is set
+type fakeEnricher struct {
+  a map[string]string
+  err error
+  calls int
+}
+
+func (e *fakeEnricher) Enrich(u string) (map[string]string, error) {
+  e.calls++
+  if e.err != nil {
+    return nil, e.err
+  }
+  return e.a, nil
+}
+
+func TestCachingEnricherErrors(t *testing.T) {
+  f := &fakeEnricher{err: errors.New("down")}
+  e := newCachingEnricher(f, time.Hour)
+
+  // a failed lookup is asked again on the next event
+  e.Enrich("u")
+  e.Enrich("u")
+  if f.calls != 2 {
+    t.Fatalf("%d lookups, want a failure not to be cached", f.calls)
+  }
+
+  f.err, f.a = nil, map[string]string{"team": "web"}
+  if a, err := e.Enrich("u"); err != nil || a["team"] != "web" {
+    t.Fatalf("got %v, %v", a, err)
+  }
+  e.Enrich("u")
+  if f.calls != 3 {
+    t.Fatalf("%d lookups, want the answer cached", f.calls)
+  }
+
+  // once stale, a failing lookup still hands out the old annotations
+  e.ttl = 0
+  f.err = errors.New("down")
+  if a, err := e.Enrich("u"); err == nil || a["team"] != "web" {
+    t.Fatalf("got %v, %v, want the stale annotations and the error", a, err)
+  }
+}
+
+// a lockedBuffer collects log output written from other goroutines
+type lockedBuffer struct {
+  mu sync.Mutex
+  b bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  return l.b.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  return l.b.String()
+}
+
+func TestEnrichedEvents(t *testing.T) {
+  setThresholds(t, 1, 1)
+  ts, posts := postServer(t)
+  setWebhook(t, ts.URL, "generic")
+  var logged lockedBuffer
+  log.SetOutput(&logged)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+  enricher = &fakeEnricher{a: map[string]string{"team": "web", "runbook": "http://wiki/a"}}
+  startEvents()
+  t.Cleanup(func() {
+    close(events)
+    enricher, events = nil, nil
+  })
+
+  updates, _ := StateMonitor(time.Hour, nil)
+  defer close(updates)
+  updates <- State{url: "http://a", status: "503 Service Unavailable"}
+  got := received(posts, 500*time.Millisecond)
+  if len(got) != 1 || got[0]["event"] != "down" {
+    t.Fatalf("posts %v, want one down event", got)
+  }
+  a, _ := got[0]["annotations"].(map[string]interface{})
+  if a["team"] != "web" || a["runbook"] != "http://wiki/a" {
+    t.Fatalf("webhook annotations %v", got[0]["annotations"])
+  }
+  // the log line is written before the webhook is posted
+  want := `event=down url=http://a status="503 Service Unavailable" runbook="http://wiki/a" team="web"`
+  if !strings.Contains(logged.String(), want) {
+    t.Fatalf("log has no %s:\n%s", want, logged.String())
+  }
+}
@@ -0,0 +1,123 @@
+package main
+// reporting transitions between healthy and down,
+// periodic summaries and sampled response headers
+
+import (
+  "fmt"
+  "log"
+  "net/http"
+  "strings"
+  "time"
+)
+
+// a notifier is sent monitor events by name
+// (down, reminder, recovered, summary)
+// *syslogNotifier is one
+type notifier interface {
+  notify(event, m string) error
+}
+
+// sysNotifier is the syslog notifier, if one was opened
+var sysNotifier notifier
+
+// sysNotify sends m to sysNotifier, if there is one
+func sysNotify(event, m string) {
+  if sysNotifier == nil {
+    return
+  }
+  if err := sysNotifier.notify(event, m); err != nil {
+    log.Println("Error syslog", err)
+  }
+}
+
+// notifyDown reports a URL going down
+func notifyDown(s State) {
+  s = enrich(s)
+  m := fmt.Sprintf("event=down url=%s status=%q%s", s.url, s.status, eventFields(s))
+  log.Println(m)
+  sysNotify("down", m)
+  sendWebhook("down", s, 0)
+}
+
+// notifyReminder reports a URL that is still down
+// n counts the reminders sent since it went down
+func notifyReminder(s State, n int, down time.Duration) {
+  s = enrich(s)
+  m := fmt.Sprintf("event=reminder url=%s reminder=%d down_for=%v status=%q%s", s.url, n, down.Round(time.Second), s.status, eventFields(s))
+  log.Println(m)
+  sysNotify("reminder", m)
+  sendWebhook("reminder", s, n)
+}
+
+// notifyRecovered reports a down URL being healthy again
+func notifyRecovered(s State) {
+  s = enrich(s)
+  m := fmt.Sprintf("event=recovered url=%s status=%q%s", s.url, s.status, eventFields(s))
+  log.Println(m)
+  sysNotify("recovered", m)
+  sendWebhook("recovered", s, 0)
+}
+
+// sampledHeaders are the response headers logged with each poll,
+// -log-headers without -redact-headers
+var sampledHeaders []string
+
+// headerList parses a comma-separated header list into canonical names,
+// leaving out any in exclude
+func headerList(list string, exclude []string) []string {
+  var hs []string
+  for _, h := range strings.Split(list, ",") {
+    h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+    skip := h == ""
+    for _, x := range exclude {
+      skip = skip || h == x
+    }
+    if !skip {
+      hs = append(hs, h)
+    }
+  }
+  return hs
+}
+
+// logPollHeaders logs the sampled headers of a poll's response
+// as one key=value line, headers the response lacks are left out
+func logPollHeaders(url string, resp *http.Response) {
+  if len(sampledHeaders) == 0 {
+    return
+  }
+  m := fmt.Sprintf("event=poll url=%s code=%d", url, resp.StatusCode)
+  for _, h := range sampledHeaders {
+    if v := resp.Header.Get(h); v != "" {
+      m += fmt.Sprintf(" %s=%q", h, v)
+    }
+  }
+  log.Println(m)
+}
+
+// eventFields are the key=value marker and annotations of an event about s
+// annotations are sorted by key so lines are stable
+func eventFields(s State) string {
+  var f string
+  if s.marker != "" {
+    f += fmt.Sprintf(" marker=%q", s.marker)
+  }
+  for _, k := range sortedKeys(s.annotations) {
+    f += fmt.Sprintf(" %s=%q", k, s.annotations[k])
+  }
+  return f
+}
+
+// notifySummary reports how many URLs are healthy
+// logState already logs the detail, so it only goes to syslog
+func notifySummary(s map[string]State) {
+  if sysNotifier == nil {
+    return
+  }
+  healthy := 0
+  for _, v := range s {
+    if v.healthy {
+      healthy++
+    }
+  }
+  sysNotify("summary", fmt.Sprintf("event=summary healthy=%d total=%d", healthy, len(s)))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+  "log"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "testing"
+)
+
+func TestSampledHeaders(t *testing.T) {
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("X-Served-By", "cache-lhr1")
+    w.Header().Set("CF-Ray", "8a1b2c3d-LHR")
+    w.Header().Set("Set-Cookie", "session=secret")
+    w.Header().Set("WWW-Authenticate", `Bearer realm="secret"`)
+  }))
+  defer ts.Close()
+  saved := sampledHeaders
+  t.Cleanup(func() { sampledHeaders = saved })
+  var logs strings.Builder
+  log.SetOutput(&logs)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  // redacted headers are dropped even when asked for, in any case
+  sampledHeaders = headerList(" x-served-by, CF-Ray,set-cookie,,WWW-Authenticate,X-Missing", headerList(*redactHeaders, nil))
+  r := &Resource{url: ts.URL}
+  if s := r.Poll(); s != "200 OK" {
+    t.Fatalf("poll: %s", s)
+  }
+  line := logs.String()
+  if !strings.Contains(line, "event=poll url="+ts.URL+" code=200") ||
+    !strings.Contains(line, `X-Served-By="cache-lhr1"`) || !strings.Contains(line, `Cf-Ray="8a1b2c3d-LHR"`) {
+    t.Fatalf("poll log %q, want the sampled headers", line)
+  }
+  if strings.Contains(line, "secret") || strings.Contains(line, "X-Missing") {
+    t.Fatalf("poll log %q has a redacted or missing header", line)
+  }
+
+  // no -log-headers, no poll line
+  logs.Reset()
+  sampledHeaders = headerList("", nil)
+  r.Poll()
+  if strings.Contains(logs.String(), "event=poll") {
+    t.Fatalf("poll logged %q without -log-headers", logs.String())
+  }
+}
@@ -0,0 +1,348 @@
+package main
+// expectations a poll's response has to meet
+// beyond getting an HTTP response at all
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// securityHeaders is the usual set, required by securityHeaderSet
+var securityHeaders = []string{"Content-Security-Policy", "Strict-Transport-Security", "X-Frame-Options"}
+
+// popHeaders name the serving PoP at common CDNs
+// Cloudflare, Fastly and CloudFront
+var popHeaders = []string{"CF-Ray", "X-Served-By", "X-Amz-Cf-Pop"}
+
+// checkHeaders returns what degrades the response's headers
+func (r *Resource) checkHeaders(resp *http.Response) []string {
+  var issues []string
+  var missing []string
+  required := r.requireSecurityHeaders
+  if r.securityHeaderSet {
+    required = append(append([]string(nil), securityHeaders...), required...)
+  }
+  for _, h := range required {
+    if resp.Header.Get(h) == "" {
+      missing = append(missing, h)
+    }
+  }
+  if len(missing) > 0 {
+    issues = append(issues, "missing "+strings.Join(missing, ", "))
+  }
+  if r.minCacheMaxAge > 0 {
+    if issue := checkCacheControl(resp.Header.Get("Cache-Control"), r.minCacheMaxAge); issue != "" {
+      issues = append(issues, issue)
+    }
+  }
+  if r.expectPoP != nil {
+    if issue := r.checkPoP(resp.Header); issue != "" {
+      issues = append(issues, issue)
+    }
+  }
+  if r.secureCookies {
+    issues = append(issues, checkCookies(resp.Cookies())...)
+  }
+  if r.maxCacheAge > 0 {
+    if age, err := strconv.Atoi(resp.Header.Get("Age")); err == nil && time.Duration(age)*time.Second > r.maxCacheAge {
+      issues = append(issues, fmt.Sprintf("stale Age %ds", age))
+    }
+  }
+  return issues
+}
+
+// checkPoP describes how the serving PoP fails to match expectPoP
+func (r *Resource) checkPoP(h http.Header) string {
+  names := popHeaders
+  if r.popHeader != "" {
+    names = []string{r.popHeader}
+  }
+  for _, name := range names {
+    v := h.Get(name)
+    if v == "" {
+      continue
+    }
+    if !r.expectPoP.MatchString(v) {
+      return fmt.Sprintf("served from unexpected PoP %s: %s, want %s", name, v, r.expectPoP)
+    }
+    return ""
+  }
+  return "no PoP header " + strings.Join(names, "/")
+}
+
+// checkCookies describes each cookie missing Secure, HttpOnly
+// or an explicit SameSite
+func checkCookies(cookies []*http.Cookie) []string {
+  var issues []string
+  for _, c := range cookies {
+    var missing []string
+    if !c.Secure {
+      missing = append(missing, "Secure")
+    }
+    if !c.HttpOnly {
+      missing = append(missing, "HttpOnly")
+    }
+    // a cookie without the attribute parses as 0, a bare SameSite as the default mode
+    if c.SameSite == 0 || c.SameSite == http.SameSiteDefaultMode {
+      missing = append(missing, "SameSite")
+    }
+    if len(missing) > 0 {
+      issues = append(issues, fmt.Sprintf("cookie %s without %s", c.Name, strings.Join(missing, ", ")))
+    }
+  }
+  return issues
+}
+
+// checkCacheControl describes how cc fails to allow caching for min
+// s-maxage is preferred over max-age, as shared caches do
+func checkCacheControl(cc string, min time.Duration) string {
+  if cc == "" {
+    return "missing Cache-Control"
+  }
+  maxAge, sMaxAge := -1, -1
+  for _, d := range strings.Split(cc, ",") {
+    name, value, _ := strings.Cut(strings.ToLower(strings.TrimSpace(d)), "=")
+    switch name {
+    case "no-store", "no-cache":
+      return "Cache-Control " + name
+    case "max-age":
+      maxAge, _ = strconv.Atoi(strings.Trim(value, `"`))
+    case "s-maxage":
+      sMaxAge, _ = strconv.Atoi(strings.Trim(value, `"`))
+    }
+  }
+  if sMaxAge >= 0 {
+    maxAge = sMaxAge
+  }
+  if maxAge < 0 {
+    return "Cache-Control without max-age"
+  }
+  if time.Duration(maxAge)*time.Second < min {
+    return fmt.Sprintf("Cache-Control max-age %ds under %v", maxAge, min)
+  }
+  return ""
+}
+
+// needsBody reports whether polls of r have to GET the body
+func (r *Resource) needsBody() bool {
+  return len(r.expectJSON) > 0 || r.expectSniffedType != "" || len(r.expectTrailers) > 0 ||
+    r.minBodyBytes > 0 || r.maxBodyBytes > 0
+}
+
+// readLimit is how much of the body polls read
+// at least minBodyBytes, so a body that big is seen whole,
+// and one byte past maxBodyBytes, so an oversized body is seen as one
+func (r *Resource) readLimit() int64 {
+  return max(bodyCap, r.minBodyBytes, r.maxBodyBytes+1)
+}
+
+// checkBody returns an error describing the first expectation
+// the body doesn't meet
+func (r *Resource) checkBody(body []byte) error {
+  if err := r.checkBodySize(int64(len(body))); err != nil {
+    return err
+  }
+  if len(r.expectJSON) > 0 {
+    if err := checkJSON(body, r.expectJSON); err != nil {
+      return err
+    }
+  }
+  if r.expectSniffedType != "" {
+    if err := checkSniffedType(body, r.expectSniffedType); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// checkBodySize compares the number of body bytes read to the expected range
+func (r *Resource) checkBodySize(n int64) error {
+  if r.minBodyBytes > 0 && n < r.minBodyBytes {
+    return fmt.Errorf("body size: %d bytes, want at least %d", n, r.minBodyBytes)
+  }
+  if r.maxBodyBytes > 0 && n > r.maxBodyBytes {
+    return fmt.Errorf("body size: over %d bytes", r.maxBodyBytes)
+  }
+  return nil
+}
+
+// checkProto compares the negotiated protocol to want
+// "HTTP/2" is taken to mean "HTTP/2.0"
+func checkProto(resp *http.Response, want string) error {
+  if want == "" || resp.Proto == want || resp.Proto == want+".0" {
+    return nil
+  }
+  return fmt.Errorf("expectProto: got %s, want %s", resp.Proto, want)
+}
+
+// a countRange is an inclusive range of counts
+type countRange struct {
+  min, max int
+}
+
+// contains reports whether n is in the range
+func (c *countRange) contains(n int) bool {
+  return n >= c.min && n <= c.max
+}
+
+// String formats the range as "n" or "min-max"
+func (c *countRange) String() string {
+  if c.min == c.max {
+    return strconv.Itoa(c.min)
+  }
+  return fmt.Sprintf("%d-%d", c.min, c.max)
+}
+
+// redirectCount returns how many redirects led to resp
+// each redirect leaves its response on the request that followed it
+func redirectCount(resp *http.Response) int {
+  n := 0
+  for req := resp.Request; req.Response != nil; req = req.Response.Request {
+    n++
+  }
+  return n
+}
+
+// checkNoRedirect fails a response that redirects
+// a Location outside a 3xx counts too
+func checkNoRedirect(resp *http.Response) error {
+  loc := resp.Header.Get("Location")
+  if resp.StatusCode >= 300 && resp.StatusCode < 400 || loc != "" {
+    return fmt.Errorf("noRedirect: got %s to %q", resp.Status, loc)
+  }
+  return nil
+}
+
+// checkHSTS audits an http:// URL's upgrade to https
+// the poll must have been redirected to the same host over https
+// and the final response must carry HSTS with a max-age of at least min
+func checkHSTS(resp *http.Response, min time.Duration) error {
+  first := resp.Request
+  for first.Response != nil {
+    first = first.Response.Request
+  }
+  final := resp.Request.URL
+  if final.Scheme != "https" || final.Hostname() != first.URL.Hostname() {
+    return fmt.Errorf("hsts audit: not redirected to https://%s", first.URL.Hostname())
+  }
+  hsts := resp.Header.Get("Strict-Transport-Security")
+  if hsts == "" {
+    return fmt.Errorf("hsts audit: missing Strict-Transport-Security")
+  }
+  for _, d := range strings.Split(hsts, ";") {
+    name, value, _ := strings.Cut(strings.ToLower(strings.TrimSpace(d)), "=")
+    if name != "max-age" {
+      continue
+    }
+    age, err := strconv.Atoi(strings.Trim(value, `"`))
+    if err != nil {
+      return fmt.Errorf("hsts audit: bad max-age %q", value)
+    }
+    if time.Duration(age)*time.Second < min {
+      return fmt.Errorf("hsts audit: max-age %ds under %v", age, min)
+    }
+    return nil
+  }
+  return fmt.Errorf("hsts audit: Strict-Transport-Security without max-age")
+}
+
+// checkTrailers compares the response's trailers to the expected values
+// names are checked in sorted order
+func checkTrailers(trailer http.Header, expect map[string]string) error {
+  names := make([]string, 0, len(expect))
+  for n := range expect {
+    names = append(names, n)
+  }
+  sort.Strings(names)
+  for _, n := range names {
+    got, ok := trailer[http.CanonicalHeaderKey(n)]
+    if !ok {
+      return fmt.Errorf("expectTrailers %s: missing", n)
+    }
+    if strings.Join(got, ", ") != expect[n] {
+      return fmt.Errorf("expectTrailers %s: got %q, want %q", n, strings.Join(got, ", "), expect[n])
+    }
+  }
+  return nil
+}
+
+// checkSniffedType compares the type sniffed from the body's leading bytes
+// to want, which may end in /* to match any subtype
+func checkSniffedType(body []byte, want string) error {
+  got, _, _ := strings.Cut(http.DetectContentType(body), ";")
+  if got == want || strings.HasSuffix(want, "/*") && strings.HasPrefix(got, strings.TrimSuffix(want, "*")) {
+    return nil
+  }
+  return fmt.Errorf("expectSniffedType: got %s, want %s", got, want)
+}
+
+// checkJSON parses body and compares the value at each path
+// to the expected one; paths are checked in sorted order
+func checkJSON(body []byte, expect map[string]string) error {
+  var doc interface{}
+  if err := json.Unmarshal(body, &doc); err != nil {
+    return fmt.Errorf("expectJSON: body is not JSON: %v", err)
+  }
+  paths := make([]string, 0, len(expect))
+  for p := range expect {
+    paths = append(paths, p)
+  }
+  sort.Strings(paths)
+  for _, p := range paths {
+    v, ok := lookupJSON(doc, p)
+    if !ok {
+      return fmt.Errorf("expectJSON %s: missing", p)
+    }
+    if got := jsonString(v); got != expect[p] {
+      return fmt.Errorf("expectJSON %s: got %q, want %q", p, got, expect[p])
+    }
+  }
+  return nil
+}
+
+// lookupJSON finds the value at path in doc
+// path is either a JSON pointer ("/a/0/b") or dotted ("a.0.b")
+func lookupJSON(doc interface{}, path string) (interface{}, bool) {
+  var keys []string
+  if strings.HasPrefix(path, "/") {
+    for _, k := range strings.Split(path[1:], "/") {
+      keys = append(keys, strings.NewReplacer("~1", "/", "~0", "~").Replace(k))
+    }
+  } else {
+    keys = strings.Split(path, ".")
+  }
+  v := doc
+  for _, k := range keys {
+    switch n := v.(type) {
+    case map[string]interface{}:
+      var ok bool
+      if v, ok = n[k]; !ok {
+        return nil, false
+      }
+    case []interface{}:
+      i, err := strconv.Atoi(k)
+      if err != nil || i < 0 || i >= len(n) {
+        return nil, false
+      }
+      v = n[i]
+    default:
+      return nil, false
+    }
+  }
+  return v, true
+}
+
+// jsonString formats a JSON value for comparison
+// strings are compared unquoted, anything else as compact JSON
+func jsonString(v interface{}) string {
+  if s, ok := v.(string); ok {
+    return s
+  }
+  b, _ := json.Marshal(v)
+  return string(b)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+  "crypto/x509"
+  "fmt"
+  "io"
+  "log"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "os"
+  "regexp"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestBodySize(t *testing.T) {
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte(strings.Repeat("x", 3<<20)))
+  }))
+  defer ts.Close()
+
+  cases := []struct {
+    min, max int64
+    healthy bool
+  }{
+    {2 << 20, 0, true}, // min over bodyCap
+    {0, 4 << 20, true}, // max over bodyCap
+    {3 << 20, 3 << 20, true},
+    {4 << 20, 0, false}, // too small
+    {0, 2 << 20, false}, // too large
+    {0, 100, false},
+  }
+  for _, c := range cases {
+    r := &Resource{url: ts.URL, minBodyBytes: c.min, maxBodyBytes: c.max}
+    s := r.Poll()
+    if healthy := r.errCount == 0; healthy != c.healthy {
+      t.Errorf("min %d max %d: %s, want healthy %v", c.min, c.max, s, c.healthy)
+    }
+  }
+}
+
+func TestCheckJSON(t *testing.T) {
+  body := []byte(`{"status":"ok","db":{"up":true,"replicas":[{"lag":0},{"lag":3}]},"a/b":{"~c":1}}`)
+  cases := []struct {
+    expect map[string]string
+    err string // "" when the body matches
+  }{
+    {map[string]string{"status": "ok"}, ""},
+    {map[string]string{"db.up": "true", "db.replicas.1.lag": "3"}, ""},
+    {map[string]string{"/db/replicas/0/lag": "0", "/a~1b/~0c": "1"}, ""},
+    {map[string]string{"db.replicas.0": `{"lag":0}`}, ""},
+    {map[string]string{"status": "degraded"}, `expectJSON status: got "ok", want "degraded"`},
+    {map[string]string{"db.up": "false"}, `expectJSON db.up: got "true", want "false"`},
+    {map[string]string{"db.down": "true"}, "expectJSON db.down: missing"},
+    {map[string]string{"db.replicas.2.lag": "0"}, "expectJSON db.replicas.2.lag: missing"},
+    {map[string]string{"status.code": "ok"}, "expectJSON status.code: missing"},
+    // paths are checked in sorted order, so the first failure is stable
+    {map[string]string{"status": "bad", "db.up": "false"}, `expectJSON db.up: got "true", want "false"`},
+  }
+  for _, c := range cases {
+    err := checkJSON(body, c.expect)
+    if got := fmt.Sprint(err); c.err == "" && err != nil || c.err != "" && got != c.err {
+      t.Errorf("%v: error %v, want %q", c.expect, err, c.err)
+    }
+  }
+  if err := checkJSON([]byte("<html>"), map[string]string{"status": "ok"}); err == nil || !strings.Contains(err.Error(), "not JSON") {
+    t.Errorf("HTML body: error %v", err)
+  }
+}
+
+func TestSecurityHeaders(t *testing.T) {
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    // /all sends every header, / only X-Frame-Options
+    if r.URL.Path == "/all" {
+      w.Header().Set("Content-Security-Policy", "default-src 'self'")
+      w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+      w.Header().Set("X-Content-Type-Options", "nosniff")
+    }
+    w.Header().Set("X-Frame-Options", "DENY")
+  }))
+  defer ts.Close()
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  cases := []struct {
+    r *Resource
+    status string
+  }{
+    {&Resource{url: ts.URL + "/all", securityHeaderSet: true, requireSecurityHeaders: []string{"X-Content-Type-Options"}}, "200 OK"},
+    {&Resource{url: ts.URL, requireSecurityHeaders: []string{"X-Frame-Options"}}, "200 OK"},
+    {&Resource{url: ts.URL, securityHeaderSet: true},
+      "200 OK DEGRADED (missing Content-Security-Policy, Strict-Transport-Security)"},
+    {&Resource{url: ts.URL, securityHeaderSet: true, requireSecurityHeaders: []string{"x-content-type-options"}},
+      "200 OK DEGRADED (missing Content-Security-Policy, Strict-Transport-Security, x-content-type-options)"},
+  }
+  for _, c := range cases {
+    s := c.r.Poll()
+    if s != c.status || c.r.errCount != 0 || c.r.degraded != (s != "200 OK") {
+      t.Errorf("%s %v %v: %s, degraded %v, want %s", c.r.url, c.r.securityHeaderSet, c.r.requireSecurityHeaders, s, c.r.degraded, c.status)
+    }
+  }
+}
+
+func TestCacheHeaders(t *testing.T) {
+  cases := map[string]string{
+    "max-age=3600": "",
+    "public, max-age=600, s-maxage=3600": "", // shared caches go by s-maxage
+    `max-age="3600"`: "",
+    "max-age=3600, s-maxage=60": "Cache-Control max-age 60s under 5m0s",
+    "max-age=0": "Cache-Control max-age 0s under 5m0s",
+    "public": "Cache-Control without max-age",
+    "no-store": "Cache-Control no-store",
+    "max-age=3600, No-Cache": "Cache-Control no-cache",
+    "": "missing Cache-Control",
+  }
+  for cc, want := range cases {
+    if got := checkCacheControl(cc, 5*time.Minute); got != want {
+      t.Errorf("Cache-Control %q: %q, want %q", cc, got, want)
+    }
+  }
+
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Cache-Control", r.URL.Query().Get("cc"))
+    w.Header().Set("Age", r.URL.Query().Get("age"))
+  }))
+  defer ts.Close()
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+  polls := map[string]string{
+    "?cc=max-age%3D3600&age=100": "200 OK",
+    "?cc=max-age%3D3600&age=7200": "200 OK DEGRADED (stale Age 7200s)",
+    "?cc=no-cache&age=7200": "200 OK DEGRADED (Cache-Control no-cache; stale Age 7200s)",
+  }
+  for q, want := range polls {
+    r := &Resource{url: ts.URL + "/" + q, minCacheMaxAge: time.Minute, maxCacheAge: time.Hour}
+    if s := r.Poll(); s != want {
+      t.Errorf("%s: %s, want %s", q, s, want)
+    }
+  }
+}
+
+func TestSniffedType(t *testing.T) {
+  // the smallest PNG signature DetectContentType knows
+  png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 16)
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    // a declared type that lies is what sniffing is for
+    w.Header().Set("Content-Type", "image/png")
+    if r.URL.Path == "/error" {
+      w.Write([]byte("<!DOCTYPE html><html><body>Something went wrong</body></html>"))
+      return
+    }
+    w.Write([]byte(png))
+  }))
+  defer ts.Close()
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  cases := []struct {
+    path, expect, status string
+  }{
+    {"/image", "image/png", "200 OK"},
+    {"/image", "image/*", "200 OK"},
+    {"/error", "image/png", "expectSniffedType: got text/html, want image/png"},
+    {"/error", "image/*", "expectSniffedType: got text/html, want image/*"},
+    {"/image", "application/pdf", "expectSniffedType: got image/png, want application/pdf"},
+  }
+  for _, c := range cases {
+    r := &Resource{url: ts.URL + c.path, expectSniffedType: c.expect}
+    if s := r.Poll(); s != c.status || (r.errCount == 0) != (c.status == "200 OK") {
+      t.Errorf("%s as %s: %s, errCount %d, want %s", c.path, c.expect, s, r.errCount, c.status)
+    }
+  }
+}
+
+func TestTrailers(t *testing.T) {
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+    w.Write([]byte("body"))
+    w.(http.Flusher).Flush() // chunked, so the trailers follow the body
+    w.Header().Set("Grpc-Status", r.URL.Query().Get("status"))
+    w.Header().Set("Grpc-Message", "fine")
+  }))
+  defer ts.Close()
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  cases := []struct {
+    status string
+    expect map[string]string
+    want string
+  }{
+    {"0", map[string]string{"grpc-status": "0"}, "200 OK"},
+    {"0", map[string]string{"Grpc-Status": "0", "Grpc-Message": "fine"}, "200 OK"},
+    {"14", map[string]string{"grpc-status": "0"}, `expectTrailers grpc-status: got "14", want "0"`},
+    {"0", map[string]string{"X-Checksum": "abc"}, "expectTrailers X-Checksum: missing"},
+  }
+  for _, c := range cases {
+    r := &Resource{url: ts.URL + "/?status=" + c.status, expectTrailers: c.expect}
+    if s := r.Poll(); s != c.want {
+      t.Errorf("grpc-status %s with %v: %s, want %s", c.status, c.expect, s, c.want)
+    }
+  }
+}
+
+func TestExpectProto(t *testing.T) {
+  h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+  h1 := httptest.NewTLSServer(h)
+  defer h1.Close()
+  h2 := httptest.NewUnstartedServer(h)
+  h2.EnableHTTP2 = true
+  h2.StartTLS()
+  defer h2.Close()
+  pool := x509.NewCertPool()
+  pool.AddCert(h1.Certificate())
+  pool.AddCert(h2.Certificate())
+  tr := newTransport()
+  tr.TLSClientConfig.RootCAs = pool
+  defer tr.CloseIdleConnections()
+  saved := client
+  client = &http.Client{Transport: tr}
+  t.Cleanup(func() { client = saved })
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  cases := []struct {
+    url, expect, want string
+  }{
+    {h2.URL, "HTTP/2.0", "200 OK"},
+    {h2.URL, "HTTP/2", "200 OK"},
+    {h1.URL, "HTTP/1.1", "200 OK"},
+    {h1.URL, "", "200 OK"},
+    // an h2 endpoint downgraded, and one that must not serve h2
+    {h1.URL, "HTTP/2", "expectProto: got HTTP/1.1, want HTTP/2"},
+    {h2.URL, "HTTP/1.1", "expectProto: got HTTP/2.0, want HTTP/1.1"},
+  }
+  for _, c := range cases {
+    r := &Resource{url: c.url, expectProto: c.expect}
+    if s := r.Poll(); s != c.want || (r.errCount == 0) != (c.want == "200 OK") {
+      t.Errorf("%s expecting %q: %s, want %s", c.url, c.expect, s, c.want)
+    }
+  }
+}
+
+func TestHSTSAudit(t *testing.T) {
+  secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if v := r.URL.Query().Get("hsts"); v != "" {
+      w.Header().Set("Strict-Transport-Security", v)
+    }
+  }))
+  defer secure.Close()
+  plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path == "/upgrade" {
+      http.Redirect(w, r, secure.URL+"/?"+r.URL.RawQuery, http.StatusMovedPermanently)
+    }
+  }))
+  defer plain.Close()
+  pool := x509.NewCertPool()
+  pool.AddCert(secure.Certificate())
+  tr := newTransport()
+  tr.TLSClientConfig.RootCAs = pool
+  saved := client
+  client = &http.Client{Transport: tr}
+  t.Cleanup(func() { client = saved })
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  cases := map[string]string{
+    "/upgrade?hsts=max-age%3D31536000%3B+includeSubDomains": "200 OK",
+    "/upgrade?hsts=max-age%3D3600": "hsts audit: max-age 3600s under 24h0m0s",
+    "/upgrade?hsts=includeSubDomains": "hsts audit: Strict-Transport-Security without max-age",
+    "/upgrade": "hsts audit: missing Strict-Transport-Security",
+    "/": "hsts audit: not redirected to https://127.0.0.1",
+  }
+  for path, want := range cases {
+    r := &Resource{url: plain.URL + path, minHSTSAge: 24 * time.Hour}
+    if s := r.Poll(); s != want || (r.errCount == 0) != (want == "200 OK") {
+      t.Errorf("%s: %s, want %s", path, s, want)
+    }
+  }
+}
+
+func TestNoRedirect(t *testing.T) {
+  ts := redirectServer(t)
+  odd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Location", "/elsewhere")
+  }))
+  defer odd.Close()
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  cases := map[string]string{
+    ts.URL + "/0": "200 OK",
+    ts.URL + "/1": `noRedirect: got 302 Found to "/0"`,
+    // the first response is checked, not where following it would end
+    ts.URL + "/3": `noRedirect: got 302 Found to "/2"`,
+    odd.URL: `noRedirect: got 200 OK to "/elsewhere"`,
+  }
+  for url, want := range cases {
+    r := &Resource{url: url, noRedirect: true}
+    if s := r.Poll(); s != want || (r.errCount == 0) != (want == "200 OK") {
+      t.Errorf("%s: %s, want %s", url, s, want)
+    }
+  }
+}
+
+func TestExpectRedirects(t *testing.T) {
+  ts := redirectServer(t)
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  ranges := []struct {
+    expect *countRange
+    pass [3]bool // after 0, 1 and 2 redirects
+  }{
+    {&countRange{1, 1}, [3]bool{false, true, false}},
+    {&countRange{0, 0}, [3]bool{true, false, false}},
+    {&countRange{1, 2}, [3]bool{false, true, true}},
+  }
+  for _, rg := range ranges {
+    for n, pass := range rg.pass {
+      r := &Resource{url: fmt.Sprintf("%s/%d", ts.URL, n), expectRedirects: rg.expect}
+      s := r.Poll()
+      if pass && s != "200 OK" {
+        t.Errorf("%d redirects, expecting %v: %s", n, rg.expect, s)
+      }
+      if want := fmt.Sprintf("expectRedirects: followed %d, want %v", n, rg.expect); !pass && s != want {
+        t.Errorf("%d redirects, expecting %v: %s, want %s", n, rg.expect, s, want)
+      }
+    }
+  }
+}
+
+func TestExpectPoP(t *testing.T) {
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    for k, v := range r.URL.Query() {
+      w.Header().Set(k, v[0])
+    }
+  }))
+  defer ts.Close()
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+  europe := regexp.MustCompile(`-(LHR|CDG|FRA)$`)
+
+  cases := []struct {
+    query, header, want string
+  }{
+    {"?CF-Ray=8a1b2c3d-LHR", "", "200 OK"},
+    {"?X-Served-By=cache-fra1&X-Amz-Cf-Pop=FRA56", "", "200 OK DEGRADED (served from unexpected PoP X-Served-By: cache-fra1, want -(LHR|CDG|FRA)$)"},
+    {"?CF-Ray=8a1b2c3d-IAD", "", "200 OK DEGRADED (served from unexpected PoP CF-Ray: 8a1b2c3d-IAD, want -(LHR|CDG|FRA)$)"},
+    {"", "", "200 OK DEGRADED (no PoP header CF-Ray/X-Served-By/X-Amz-Cf-Pop)"},
+    // popHeader names the one header to go by
+    {"?CF-Ray=8a1b2c3d-IAD&X-Pop=edge-CDG", "X-Pop", "200 OK"},
+    {"?CF-Ray=8a1b2c3d-LHR", "X-Pop", "200 OK DEGRADED (no PoP header X-Pop)"},
+  }
+  for _, c := range cases {
+    r := &Resource{url: ts.URL + "/" + c.query, expectPoP: europe, popHeader: c.header}
+    if s := r.Poll(); s != c.want || r.errCount != 0 {
+      t.Errorf("%s %s: %s, want %s", c.query, c.header, s, c.want)
+    }
+  }
+}
+
+func TestSecureCookies(t *testing.T) {
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    for _, c := range r.URL.Query()["c"] {
+      w.Header().Add("Set-Cookie", c)
+    }
+  }))
+  defer ts.Close()
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+  cases := []struct {
+    cookies []string
+    want string
+  }{
+    {nil, "200 OK"},
+    {[]string{"s=1; Secure; HttpOnly; SameSite=Lax"}, "200 OK"},
+    {[]string{"s=1; Secure; HttpOnly; SameSite=Strict", "t=2; Secure; HttpOnly; SameSite=None"}, "200 OK"},
+    {[]string{"s=1; HttpOnly; SameSite=Lax"}, "200 OK DEGRADED (cookie s without Secure)"},
+    {[]string{"s=1; Secure; SameSite=Lax"}, "200 OK DEGRADED (cookie s without HttpOnly)"},
+    // a bare SameSite leaves the mode to the browser
+    {[]string{"s=1; Secure; HttpOnly; SameSite"}, "200 OK DEGRADED (cookie s without SameSite)"},
+    {[]string{"s=1; Secure; HttpOnly; SameSite=Lax", "t=2"},
+      "200 OK DEGRADED (cookie t without Secure, HttpOnly, SameSite)"},
+  }
+  for _, c := range cases {
+    q := url.Values{"c": c.cookies}
+    r := &Resource{url: ts.URL + "/?" + q.Encode(), secureCookies: true}
+    if s := r.Poll(); s != c.want || r.errCount != 0 || r.degraded != (c.want != "200 OK") {
+      t.Errorf("%q: %s, want %s", c.cookies, s, c.want)
+    }
+  }
+}
@@ -0,0 +1,3 @@
+module github.com/sarahheacock/go-concurrency
+
+go 1.22
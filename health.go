@@ -0,0 +1,139 @@
+package main
+// deciding when a URL is down from the outcomes of its polls
+
+import "time"
+
+// a health tracks whether a URL is down
+type health struct {
+  down bool
+  fails int // consecutive failed polls
+  oks int // consecutive healthy polls
+  polls int // polls observed
+  passed int // healthy polls observed
+  since time.Time // when the URL went down
+  alerted time.Time // when the down alert or last reminder went out
+  reminders int // reminders sent since the URL went down
+  outcomes []bool // ring of the last quorumN outcomes, in quorum mode
+  recoveries int // incidents that have ended
+  downtime time.Duration // total length of the ended incidents
+  recovered time.Time // when the last incident ended
+  gaps int // times the URL went down again after recovering
+  between time.Duration // total time from recovering to going down again
+}
+
+// quorum mode: a URL is healthy while at least quorumM
+// of its last quorumN polls were, set by -quorum
+var quorumM, quorumN int
+
+// remind reports whether a reminder is due for a URL
+// that is still down every interval after it went down
+func (h *health) remind(interval time.Duration) bool {
+  if !h.down || time.Since(h.alerted) < interval {
+    return false
+  }
+  h.alerted = time.Now()
+  h.reminders++
+  return true
+}
+
+// uptime returns the percentage of observed polls that were healthy
+func (h *health) uptime() float64 {
+  if h.polls == 0 {
+    return 0
+  }
+  return 100 * float64(h.passed) / float64(h.polls)
+}
+
+// observe records the outcome of a poll and reports whether
+// it made the URL go down or recover
+// going down takes -fail-threshold failures in a row,
+// recovering takes -recover-threshold healthy polls in a row,
+// unless quorum mode decides instead
+func (h *health) observe(s State) bool {
+  h.polls++
+  if s.healthy {
+    h.passed++
+    h.fails = 0
+    h.oks++
+  } else {
+    h.oks = 0
+    h.fails++
+  }
+  down := h.down
+  switch {
+  case quorumN > 0:
+    down = h.windowFailures(s.healthy) > quorumN-quorumM
+  case s.healthy:
+    down = down && h.oks < *recoverThreshold
+  default:
+    down = down || h.fails >= *failThreshold
+  }
+  if down == h.down {
+    return false
+  }
+  h.down = down
+  if down {
+    h.since = time.Now()
+    h.alerted, h.reminders = h.since, 0
+    if !h.recovered.IsZero() {
+      h.gaps++
+      h.between += h.since.Sub(h.recovered)
+    }
+  } else {
+    h.recovered = time.Now()
+    h.recoveries++
+    h.downtime += h.recovered.Sub(h.since)
+  }
+  return true
+}
+
+// mttr returns the mean time to recovery of the ended incidents
+// and false before any incident has ended
+func (h *health) mttr() (time.Duration, bool) {
+  if h.recoveries == 0 {
+    return 0, false
+  }
+  return h.downtime / time.Duration(h.recoveries), true
+}
+
+// mtbf returns the mean time between failures,
+// from each recovery to the next time the URL went down,
+// and false before the URL has gone down again after a recovery
+func (h *health) mtbf() (time.Duration, bool) {
+  if h.gaps == 0 {
+    return 0, false
+  }
+  return h.between / time.Duration(h.gaps), true
+}
+
+// reliability describes MTTR and MTBF for reports
+func (h *health) reliability() (mttr, mtbf string) {
+  mttr, mtbf = "insufficient data", "insufficient data"
+  if d, ok := h.mttr(); ok {
+    mttr = d.Round(time.Second).String()
+  }
+  if d, ok := h.mtbf(); ok {
+    mtbf = d.Round(time.Second).String()
+  }
+  return mttr, mtbf
+}
+
+// windowFailures adds an outcome to the ring and returns how many
+// of the last quorumN polls failed
+// before quorumN polls, the missing ones count as healthy
+func (h *health) windowFailures(healthy bool) int {
+  if h.outcomes == nil {
+    h.outcomes = make([]bool, quorumN)
+    for i := range h.outcomes {
+      h.outcomes[i] = true
+    }
+  }
+  h.outcomes[(h.polls-1)%quorumN] = healthy
+  failures := 0
+  for _, ok := range h.outcomes {
+    if !ok {
+      failures++
+    }
+  }
+  return failures
+}
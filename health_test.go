@@ -0,0 +1,264 @@
+package main
+
+import (
+  "log"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+// setThresholds sets -fail-threshold and -recover-threshold for a test
+func setThresholds(t *testing.T, fail, recover int) {
+  t.Helper()
+  savedFail, savedRecover := *failThreshold, *recoverThreshold
+  *failThreshold, *recoverThreshold = fail, recover
+  t.Cleanup(func() { *failThreshold, *recoverThreshold = savedFail, savedRecover })
+}
+
+func TestThresholds(t *testing.T) {
+  setThresholds(t, 2, 3)
+  h := &health{}
+  steps := []struct {
+    healthy bool
+    down bool
+  }{
+    {false, false}, // 1 failure of 2
+    {true, false},
+    {false, false},
+    {false, true}, // 2 failures in a row
+    {true, true}, // 1 healthy poll of 3
+    {true, true},
+    {false, true}, // starts the count again
+    {true, true},
+    {true, true},
+    {true, false}, // 3 healthy polls in a row
+  }
+  for i, s := range steps {
+    flipped := h.observe(State{healthy: s.healthy})
+    if h.down != s.down {
+      t.Fatalf("poll %d: down %v, want %v", i, h.down, s.down)
+    }
+    if want := i > 0 && steps[i-1].down != s.down; flipped != want {
+      t.Fatalf("poll %d: observe reported a flip %v, want %v", i, flipped, want)
+    }
+  }
+}
+
+func TestDependsOnDown(t *testing.T) {
+  setThresholds(t, 3, 1)
+  updates, queries := StateMonitor(time.Hour, nil)
+  up := func() bool {
+    reply := make(chan bool)
+    queries <- healthQuery{"a", reply}
+    return <-reply
+  }
+
+  if !up() {
+    t.Fatal("a URL not polled yet counts as down")
+  }
+  // a failed poll isn't enough for a URL that takes 3 to go down
+  for i := 0; i < 2; i++ {
+    updates <- State{url: "a"}
+    if !up() {
+      t.Fatalf("down after %d failures, want 3", i+1)
+    }
+  }
+  updates <- State{url: "a"}
+  if up() {
+    t.Fatal("not down after 3 failures")
+  }
+  updates <- State{url: "a", healthy: true}
+  if !up() {
+    t.Fatal("still down after recovering")
+  }
+}
+
+func TestDependsOnBlocked(t *testing.T) {
+  setThresholds(t, 1, 1)
+  var aDown, a5xx atomic.Bool
+  a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if a5xx.Load() {
+      w.WriteHeader(http.StatusServiceUnavailable)
+      return
+    }
+    if aDown.Load() {
+      conn, _, _ := w.(http.Hijacker).Hijack()
+      conn.Close()
+    }
+  }))
+  defer a.Close()
+  var bPolls atomic.Int32
+  b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    bPolls.Add(1)
+  }))
+  defer b.Close()
+
+  updates, queries := StateMonitor(time.Hour, nil)
+  in, out := make(chan *Resource), make(chan *Resource)
+  go Poller(in, out, updates, queries)
+  defer close(in)
+  ra := &Resource{url: a.URL}
+  rb := &Resource{url: b.URL, dependsOn: a.URL}
+  poll := func(r *Resource) {
+    r.queued = time.Now()
+    in <- r
+    <-out
+  }
+
+  poll(ra)
+  poll(rb)
+  if n := bPolls.Load(); n != 1 {
+    t.Fatalf("b polled %d times while a is up, want 1", n)
+  }
+  aDown.Store(true)
+  poll(ra)
+  poll(rb)
+  poll(rb)
+  if n := bPolls.Load(); n != 1 {
+    t.Fatalf("b polled %d times, want it blocked while a is down", n)
+  }
+  aDown.Store(false)
+  poll(ra)
+  poll(rb)
+  if n := bPolls.Load(); n != 2 {
+    t.Fatalf("b polled %d times, want it polled again once a recovered", n)
+  }
+  a5xx.Store(true)
+  poll(ra)
+  poll(rb)
+  if n := bPolls.Load(); n != 2 {
+    t.Fatalf("b polled %d times, want it blocked while a answers 503", n)
+  }
+  // the monitor answers once it is done with the last update,
+  // which reads flags the next test may set
+  reply := make(chan bool)
+  queries <- healthQuery{a.URL, reply}
+  <-reply
+}
+
+func TestQuorum(t *testing.T) {
+  // the thresholds alone would take a URL down on its first failure
+  setThresholds(t, 1, 1)
+  savedM, savedN := quorumM, quorumN
+  quorumM, quorumN = 3, 5
+  t.Cleanup(func() { quorumM, quorumN = savedM, savedN })
+  h := &health{}
+  steps := []struct {
+    healthy bool
+    down bool
+  }{
+    {false, false},
+    {false, false}, // 2 failures of 5, the missing polls count as healthy
+    {false, true}, // 3 failures, only 2 of 5 healthy
+    {true, true},
+    {true, true}, // 3 of 5 healthy, but the window still holds 3 failures
+    {true, false}, // the first failure leaves the window: 3 of 5 healthy
+    {false, false},
+    {false, false}, // the third failure left as this one came in
+    {false, true},
+  }
+  for i, s := range steps {
+    h.observe(State{healthy: s.healthy})
+    if h.down != s.down {
+      t.Fatalf("poll %d: down %v, want %v", i, h.down, s.down)
+    }
+  }
+}
+
+func TestReminders(t *testing.T) {
+  setThresholds(t, 1, 1)
+  saved := *alertReminder
+  *alertReminder = 100 * time.Millisecond
+  t.Cleanup(func() { *alertReminder = saved })
+  var logged lockedBuffer
+  log.SetOutput(&logged)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+  reminders := func() []string {
+    var rs []string
+    for _, l := range strings.Split(logged.String(), "\n") {
+      if i := strings.Index(l, "event=reminder url=a "); i >= 0 {
+        rs = append(rs, strings.Fields(l[i:])[2])
+      }
+    }
+    return rs
+  }
+
+  // ticks every 10ms check for reminders due every 100ms,
+  // so the 3rd is sent by 330ms and the 4th not before 400ms
+  updates, queries := StateMonitor(10*time.Millisecond, nil)
+  updates <- State{url: "a", status: "503 Service Unavailable"}
+  time.Sleep(360 * time.Millisecond)
+  got := reminders()
+  if strings.Join(got, " ") != "reminder=1 reminder=2 reminder=3" {
+    t.Fatalf("reminders over 360ms down: %v, want 3 numbered from 1", got)
+  }
+
+  // recovering sends the recovered event and ends the reminders
+  updates <- State{url: "a", healthy: true, status: "200 OK"}
+  time.Sleep(220 * time.Millisecond)
+  if n := len(reminders()); n != 3 {
+    t.Fatalf("%d reminders after recovering, want none past the 3", n-3)
+  }
+  if !strings.Contains(logged.String(), "event=recovered url=a") {
+    t.Fatal("no recovered event")
+  }
+
+  // going down again starts the count over
+  updates <- State{url: "a"}
+  time.Sleep(160 * time.Millisecond)
+  if got := reminders(); len(got) != 4 || got[3] != "reminder=1" {
+    t.Fatalf("reminders after going down again: %v, want a 4th numbered 1", got)
+  }
+  reply := make(chan bool)
+  queries <- healthQuery{"a", reply}
+  <-reply
+  close(updates)
+}
+
+func TestReliability(t *testing.T) {
+  setThresholds(t, 1, 1)
+  h := &health{}
+  if mttr, mtbf := h.reliability(); mttr != "insufficient data" || mtbf != "insufficient data" {
+    t.Fatalf("no incidents: mttr %s, mtbf %s", mttr, mtbf)
+  }
+  near := func(d, want time.Duration) bool {
+    return d >= want && d < want+15*time.Millisecond
+  }
+
+  // down 20ms, up 40ms, down 60ms, up 20ms, down 80ms
+  h.observe(State{healthy: true})
+  h.observe(State{})
+  time.Sleep(20 * time.Millisecond)
+  h.observe(State{healthy: true})
+  // one incident has ended, but none has followed a recovery
+  if d, ok := h.mttr(); !ok || !near(d, 20*time.Millisecond) {
+    t.Fatalf("after 1 incident: mttr %v %v, want 20ms", d, ok)
+  }
+  if _, mtbf := h.reliability(); mtbf != "insufficient data" {
+    t.Fatalf("after 1 incident: mtbf %s, want insufficient data", mtbf)
+  }
+  time.Sleep(40 * time.Millisecond)
+  h.observe(State{})
+  time.Sleep(60 * time.Millisecond)
+  h.observe(State{healthy: true})
+  time.Sleep(20 * time.Millisecond)
+  h.observe(State{})
+  time.Sleep(80 * time.Millisecond)
+  h.observe(State{healthy: true})
+
+  // polls that don't change the state don't add incidents
+  h.observe(State{healthy: true})
+  if h.recoveries != 3 || h.gaps != 2 {
+    t.Fatalf("%d recoveries and %d gaps, want 3 and 2", h.recoveries, h.gaps)
+  }
+  if d, _ := h.mttr(); !near(d, 160*time.Millisecond/3) {
+    t.Fatalf("mttr %v, want the mean of 20ms, 60ms and 80ms", d)
+  }
+  if d, _ := h.mtbf(); !near(d, 30*time.Millisecond) {
+    t.Fatalf("mtbf %v, want the mean of 40ms and 20ms", d)
+  }
+}
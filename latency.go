@@ -0,0 +1,134 @@
+package main
+// latency statistics of a URL's healthy polls
+// and the -p90-health mode built on them
+
+import (
+  "fmt"
+  "math"
+  "sort"
+  "time"
+)
+
+// latencyWindow is how many recent latencies are kept per URL
+const latencyWindow = 20
+
+// minVarianceSamples is how many latencies a window needs
+// before its variation is alerted on
+const minVarianceSamples = 5
+
+// minP90Samples is how many latencies -p90-health needs before judging
+// with fewer, the p90 would be the slowest sample
+const minP90Samples = 10
+
+// latencyStats smooths a URL's poll latencies
+type latencyStats struct {
+  ema time.Duration // exponential moving average
+  n int // latencies observed
+  recent [latencyWindow]time.Duration // ring of the latest latencies
+  variable bool // whether the variation is over -max-latency-cv
+}
+
+// observe folds latency d into the statistics
+// the first latency seeds the average, later ones move it by -latency-ema-alpha
+func (l *latencyStats) observe(d time.Duration) {
+  if l.n == 0 {
+    l.ema = d
+  } else {
+    l.ema += time.Duration(*emaAlpha * float64(d-l.ema))
+  }
+  l.recent[l.n%latencyWindow] = d
+  l.n++
+}
+
+// window returns the latest latencies, oldest first
+func (l *latencyStats) window() []time.Duration {
+  if l.n <= latencyWindow {
+    return append([]time.Duration(nil), l.recent[:l.n]...)
+  }
+  i := l.n % latencyWindow
+  return append(append([]time.Duration(nil), l.recent[i:]...), l.recent[:i]...)
+}
+
+// median returns the median of the latest k latencies
+// so one spike doesn't move it, k is capped at latencyWindow
+func (l *latencyStats) median(k int) time.Duration {
+  w := l.window()
+  if k < len(w) {
+    w = w[len(w)-k:]
+  }
+  if len(w) == 0 {
+    return 0
+  }
+  sort.Slice(w, func(i, j int) bool { return w[i] < w[j] })
+  if len(w)%2 == 0 {
+    return (w[len(w)/2-1] + w[len(w)/2]) / 2
+  }
+  return w[len(w)/2]
+}
+
+// percentile returns the p-th percentile of the window, by nearest rank
+func (l *latencyStats) percentile(p float64) time.Duration {
+  w := l.window()
+  if len(w) == 0 {
+    return 0
+  }
+  sort.Slice(w, func(i, j int) bool { return w[i] < w[j] })
+  rank := int(math.Ceil(p / 100 * float64(len(w))))
+  if rank < 1 {
+    rank = 1
+  }
+  return w[rank-1]
+}
+
+// checkP90 makes a healthy poll unhealthy while the p90 latency
+// of r's recent healthy polls is over -p90-health
+// so sustained slowness fails a URL and a single slow poll doesn't
+// it is called by the Poller that owns r
+func (r *Resource) checkP90(st *State) {
+  if *p90Health <= 0 || !st.healthy {
+    return
+  }
+  r.pollLatencies.observe(st.latency)
+  if r.pollLatencies.n < minP90Samples {
+    return
+  }
+  if p90 := r.pollLatencies.percentile(90); p90 > *p90Health {
+    st.healthy = false
+    st.status = fmt.Sprintf("%s P90 LATENCY %v OVER %v", st.status, p90.Round(time.Millisecond), *p90Health)
+  }
+}
+
+// stddev returns the standard deviation of the window
+// and its coefficient of variation (stddev / mean)
+func (l *latencyStats) stddev() (time.Duration, float64) {
+  w := l.window()
+  if len(w) == 0 {
+    return 0, 0
+  }
+  var sum float64
+  for _, d := range w {
+    sum += float64(d)
+  }
+  mean := sum / float64(len(w))
+  var sq float64
+  for _, d := range w {
+    sq += (float64(d) - mean) * (float64(d) - mean)
+  }
+  sd := math.Sqrt(sq / float64(len(w)))
+  if mean == 0 {
+    return time.Duration(sd), 0
+  }
+  return time.Duration(sd), sd / mean
+}
+
+// checkVariance reports whether the window's variation just went over
+// -max-latency-cv, so it is alerted on once per excursion
+func (l *latencyStats) checkVariance() bool {
+  if *maxLatencyCV <= 0 || l.n < minVarianceSamples {
+    return false
+  }
+  _, cv := l.stddev()
+  was := l.variable
+  l.variable = cv > *maxLatencyCV
+  return l.variable && !was
+}
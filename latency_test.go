@@ -0,0 +1,189 @@
+package main
+
+import (
+  "log"
+  "os"
+  "strings"
+  "testing"
+  "time"
+)
+
+// setFloat sets a float flag for the length of a test
+func setFloat(t *testing.T, f *float64, v float64) {
+  t.Helper()
+  saved := *f
+  *f = v
+  t.Cleanup(func() { *f = saved })
+}
+
+func TestEMA(t *testing.T) {
+  setFloat(t, emaAlpha, 0.5)
+  var l latencyStats
+
+  // the first latency seeds the average, each later one moves it halfway
+  ms := time.Millisecond
+  want := []time.Duration{100 * ms, 150 * ms, 175 * ms, 187500 * time.Microsecond}
+  l.observe(100 * time.Millisecond)
+  for i, w := range want {
+    if i > 0 {
+      l.observe(200 * time.Millisecond)
+    }
+    if l.ema != w {
+      t.Fatalf("after %d latencies: ema %v, want %v", i+1, l.ema, w)
+    }
+  }
+  // a steady series pulls it all the way
+  for i := 0; i < 20; i++ {
+    l.observe(200 * time.Millisecond)
+  }
+  if d := 200*time.Millisecond - l.ema; d < 0 || d > time.Millisecond {
+    t.Fatalf("ema %v after a steady 200ms, want within 1ms of it", l.ema)
+  }
+
+  // a lower alpha reacts more slowly to the same step
+  setFloat(t, emaAlpha, 0.1)
+  var slow latencyStats
+  slow.observe(100 * time.Millisecond)
+  slow.observe(200 * time.Millisecond)
+  if got := slow.ema; got != 110*time.Millisecond {
+    t.Fatalf("alpha 0.1: ema %v after a step from 100ms to 200ms, want 110ms", got)
+  }
+}
+
+func TestLatencyVariance(t *testing.T) {
+  setFloat(t, maxLatencyCV, 0.5)
+  ms := time.Millisecond
+  series := func(ds ...time.Duration) (alerts int, l *latencyStats) {
+    l = &latencyStats{}
+    for _, d := range ds {
+      l.observe(d)
+      if l.checkVariance() {
+        alerts++
+      }
+    }
+    return alerts, l
+  }
+
+  // steady latencies around 100ms vary by a few percent
+  alerts, l := series(100*ms, 104*ms, 97*ms, 101*ms, 99*ms, 103*ms, 96*ms, 100*ms)
+  if _, cv := l.stddev(); alerts != 0 || cv > 0.05 {
+    t.Fatalf("low variance series: %d alerts, cv %.3f", alerts, cv)
+  }
+
+  // alternating fast and slow polls have the same mean but a cv of 0.9
+  alerts, l = series(10*ms, 190*ms, 10*ms, 190*ms, 10*ms, 190*ms, 10*ms, 190*ms)
+  if sd, cv := l.stddev(); alerts != 1 || sd != 90*ms || cv < 0.89 || cv > 0.91 {
+    t.Fatalf("high variance series: %d alerts, stddev %v cv %.3f, want 1 alert at 90ms and 0.9", alerts, sd, cv)
+  }
+
+  // fewer than minVarianceSamples latencies aren't judged
+  if alerts, _ := series(10*ms, 190*ms, 10*ms, 190*ms); alerts != 0 {
+    t.Fatalf("%d alerts for 4 latencies", alerts)
+  }
+
+  // once the window settles the excursion is over, and a new one alerts again
+  l = &latencyStats{}
+  alerts = 0
+  for i := 0; i < 3*latencyWindow; i++ {
+    d := 100 * ms
+    if i < 8 || i >= 2*latencyWindow+10 {
+      d = []time.Duration{10 * ms, 190 * ms}[i%2]
+    }
+    l.observe(d)
+    if l.checkVariance() {
+      alerts++
+    }
+  }
+  if alerts != 2 {
+    t.Fatalf("%d alerts for two excursions", alerts)
+  }
+}
+
+func TestLatencyMedian(t *testing.T) {
+  ms := time.Millisecond
+  l := &latencyStats{}
+  for _, d := range []time.Duration{100, 102, 98, 2000, 101} {
+    l.observe(d * ms)
+  }
+  // the spike is in the raw window but not the median
+  if w := l.window(); len(w) != 5 || w[3] != 2000*ms {
+    t.Fatalf("window %v, want the raw latencies with the spike", w)
+  }
+  cases := map[int]time.Duration{
+    5: 101 * ms,
+    3: 101 * ms, // of 98ms, 2s and 101ms
+    2: 1050500 * time.Microsecond, // of 2s and 101ms, too few to outvote the spike
+    50: 101 * ms, // k is capped at what there is
+  }
+  for k, want := range cases {
+    if got := l.median(k); got != want {
+      t.Errorf("median of %d: %v, want %v", k, got, want)
+    }
+  }
+
+  // the status log reports the median beside the raw latency
+  saved := *latencyMedian
+  *latencyMedian = 5
+  t.Cleanup(func() { *latencyMedian = saved })
+  var logs strings.Builder
+  log.SetOutput(&logs)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+  logState(map[string]State{"a": {url: "a", status: "200 OK", latency: 2000 * ms}},
+    nil, map[string]*latencyStats{"a": l}, nil)
+  if !strings.Contains(logs.String(), " a 200 OK 2s (") || !strings.Contains(logs.String(), "median of 5 101ms") {
+    t.Fatalf("status log %q, want the raw 2s and a median of 101ms", logs.String())
+  }
+}
+
+func TestP90Health(t *testing.T) {
+  saved := *p90Health
+  *p90Health = 150 * time.Millisecond
+  t.Cleanup(func() { *p90Health = saved })
+  ms := time.Millisecond
+  poll := func(r *Resource, d time.Duration) State {
+    st := State{url: "a", status: "200 OK", healthy: true, latency: d}
+    r.checkP90(&st)
+    return st
+  }
+
+  // 2 slow polls in 20 are over the threshold, but not the p90
+  r := &Resource{}
+  for i := 0; i < 20; i++ {
+    d := 100 * ms
+    if i == 5 || i == 19 {
+      d = 400 * ms
+    }
+    if st := poll(r, d); !st.healthy || st.status != "200 OK" {
+      t.Fatalf("poll %d of %v: %s, want healthy with an occasional slow poll", i, d, st.status)
+    }
+  }
+
+  // 3 in 20 take the p90 over it, polls under the threshold fail too
+  r = &Resource{}
+  var st State
+  for i := 0; i < 20; i++ {
+    d := 100 * ms
+    if i%7 == 6 || i == 19 {
+      d = 200 * ms
+    }
+    st = poll(r, d)
+    // too few samples to judge before minP90Samples
+    if i < minP90Samples-1 && !st.healthy {
+      t.Fatalf("poll %d: %s before %d samples", i, st.status, minP90Samples)
+    }
+  }
+  if st.healthy || st.status != "200 OK P90 LATENCY 200ms OVER 150ms" {
+    t.Fatalf("sustained slowness: healthy %v %s", st.healthy, st.status)
+  }
+  if st = poll(r, 50*ms); st.healthy {
+    t.Fatal("a fast poll passed while the p90 is over the threshold")
+  }
+
+  // a failed poll is left alone and not counted
+  n := r.pollLatencies.n
+  st = State{status: "503 Service Unavailable", latency: time.Second}
+  r.checkP90(&st)
+  if st.status != "503 Service Unavailable" || r.pollLatencies.n != n {
+    t.Fatalf("failed poll: %s, %d latencies, want %d", st.status, r.pollLatencies.n, n)
+  }
+}
@@ -0,0 +1,72 @@
+package main
+// rendering the current state as a GitHub-flavored Markdown table
+// for status pages kept in a repo
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "time"
+)
+
+// renderMarkdown returns a table row per URL, sorted by URL
+func renderMarkdown(s map[string]State, healths map[string]*health) string {
+  urls := make([]string, 0, len(s))
+  for u := range s {
+    urls = append(urls, u)
+  }
+  sort.Strings(urls)
+
+  var b strings.Builder
+  b.WriteString("| URL | Status | Uptime | MTTR | MTBF | Last checked |\n")
+  b.WriteString("| --- | --- | ---: | ---: | ---: | --- |\n")
+  for _, u := range urls {
+    v := s[u]
+    uptime, mttr, mtbf := "-", "-", "-"
+    if h := healths[u]; h != nil && h.polls > 0 {
+      uptime = fmt.Sprintf("%.2f%%", h.uptime())
+      mttr, mtbf = h.reliability()
+    }
+    fmt.Fprintf(&b, "| %s | %s %s | %s | %s | %s | %s |\n", escapeCell(u), statusEmoji(v), escapeCell(v.status),
+      uptime, mttr, mtbf, v.checked.UTC().Format(time.RFC3339))
+  }
+  return b.String()
+}
+
+// statusEmoji picks the indicator for a state
+func statusEmoji(s State) string {
+  switch {
+  case s.blocked:
+    return "⏸️"
+  case !s.healthy:
+    return "🔴"
+  case s.degraded:
+    return "🟡"
+  }
+  return "🟢"
+}
+
+// escapeCell keeps text from breaking out of its table cell
+func escapeCell(s string) string {
+  return strings.NewReplacer("|", `\|`, "\n", " ", "\r", " ").Replace(s)
+}
+
+// writeMarkdown replaces the file at path with the rendered table
+// it writes a temporary file first so readers never see half a table
+func writeMarkdown(path string, s map[string]State, healths map[string]*health) error {
+  tmp, err := os.CreateTemp(filepath.Dir(path), ".status-*.md")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(tmp.Name())
+  if _, err := tmp.WriteString(renderMarkdown(s, healths)); err != nil {
+    tmp.Close()
+    return err
+  }
+  if err := tmp.Close(); err != nil {
+    return err
+  }
+  return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,59 @@
+package main
+// check subcommand: probes a single URL once
+// and reports the result as a Nagios/Icinga plugin
+
+import (
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "time"
+)
+
+// Nagios plugin exit codes
+const (
+  nagiosOK = 0
+  nagiosWarning = 1
+  nagiosCritical = 2
+  nagiosUnknown = 3
+)
+
+var nagiosLabels = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// nagiosCheck runs `check [-w duration] [-c duration] url`
+// it writes one line of plugin output with latency perfdata to w
+// and returns the plugin exit code
+func nagiosCheck(args []string, w io.Writer) int {
+  fs := flag.NewFlagSet("check", flag.ContinueOnError)
+  fs.SetOutput(io.Discard)
+  warn := fs.Duration("w", 1*time.Second, "latency above which the check is WARNING")
+  crit := fs.Duration("c", 5*time.Second, "latency above which the check is CRITICAL")
+  if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+    fmt.Fprintln(w, "UNKNOWN - usage: check [-w duration] [-c duration] url")
+    return nagiosUnknown
+  }
+
+  r := &Resource{url: fs.Arg(0)}
+  start := time.Now()
+  s := r.Poll()
+  latency := time.Since(start)
+
+  code := nagiosOK
+  switch {
+  case r.errCount > 0, r.code >= 500, latency > *crit:
+    code = nagiosCritical
+  case r.code >= 400, latency > *warn:
+    code = nagiosWarning
+  }
+  fmt.Fprintf(w, "%s - %s %s | time=%.6fs;%.6f;%.6f;0\n", nagiosLabels[code], r.url, s,
+    latency.Seconds(), warn.Seconds(), crit.Seconds())
+  return code
+}
+
+// runCheck exits with the result of the check subcommand
+// when it is given on the command line
+func runCheck() {
+  if len(os.Args) > 1 && os.Args[1] == "check" {
+    os.Exit(nagiosCheck(os.Args[2:], os.Stdout))
+  }
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "regexp"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestNagiosCheck(t *testing.T) {
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    switch r.URL.Path {
+    case "/slow":
+      time.Sleep(50 * time.Millisecond)
+    case "/missing":
+      w.WriteHeader(http.StatusNotFound)
+    case "/broken":
+      w.WriteHeader(http.StatusServiceUnavailable)
+    }
+  }))
+  defer ts.Close()
+
+  cases := []struct {
+    args []string
+    code int
+    line string // regexp of the output line
+  }{
+    {[]string{ts.URL + "/"}, nagiosOK, `^OK - %s/ 200 OK \| time=[0-9.]+s;1\.000000;5\.000000;0$`},
+    {[]string{"-w", "10ms", ts.URL + "/slow"}, nagiosWarning, `^WARNING - %s/slow 200 OK \| time=[0-9.]+s;0\.010000;5\.000000;0$`},
+    {[]string{ts.URL + "/missing"}, nagiosWarning, `^WARNING - %s/missing 404 Not Found \|`},
+    {[]string{"-w", "5ms", "-c", "10ms", ts.URL + "/slow"}, nagiosCritical, `^CRITICAL - %s/slow 200 OK \| time=[0-9.]+s;0\.005000;0\.010000;0$`},
+    {[]string{ts.URL + "/broken"}, nagiosCritical, `^CRITICAL - %s/broken 503 Service Unavailable \|`},
+    {[]string{"http://127.0.0.1:1/"}, nagiosCritical, `^CRITICAL - http://127\.0\.0\.1:1/ .*connection refused \|`},
+    {nil, nagiosUnknown, `^UNKNOWN - usage: check`},
+    {[]string{"-w", "soon", ts.URL}, nagiosUnknown, `^UNKNOWN - usage: check`},
+  }
+  for _, c := range cases {
+    var out strings.Builder
+    code := nagiosCheck(c.args, &out)
+    line := strings.TrimSuffix(out.String(), "\n")
+    if code != c.code {
+      t.Errorf("%v: exit %d, want %d (%s)", c.args, code, c.code, line)
+    }
+    re := c.line
+    if strings.Contains(re, "%s") {
+      re = fmt.Sprintf(re, regexp.QuoteMeta(ts.URL))
+    }
+    if !regexp.MustCompile(re).MatchString(line) || strings.Contains(line, "\n") {
+      t.Errorf("%v: output %q, want %s", c.args, line, re)
+    }
+  }
+}
@@ -0,0 +1,154 @@
+package main
+// checking the OCSP response a TLS server staples to its handshake
+// (RFC 6960), parsed with encoding/asn1
+// the response's signature is not verified, only its status and dates
+
+import (
+  "bytes"
+  "crypto"
+  _ "crypto/sha1"
+  _ "crypto/sha256"
+  _ "crypto/sha512"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/asn1"
+  "errors"
+  "fmt"
+  "math/big"
+  "time"
+)
+
+// the parts of an OCSPResponse the check reads
+type ocspResponse struct {
+  Status asn1.Enumerated
+  Bytes ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+  Type asn1.ObjectIdentifier
+  Response []byte
+}
+
+type ocspBasicResponse struct {
+  Data ocspResponseData
+  Algorithm asn1.RawValue
+  Signature asn1.BitString
+  Certs []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+  Version int `asn1:"optional,explicit,default:0,tag:0"`
+  ResponderID asn1.RawValue
+  ProducedAt time.Time `asn1:"generalized"`
+  Responses []ocspSingleResponse
+  Extensions []asn1.RawValue `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspSingleResponse struct {
+  CertID ocspCertID
+  Status asn1.RawValue // context tag 0 good, 1 revoked, 2 unknown
+  ThisUpdate time.Time `asn1:"generalized"`
+  NextUpdate time.Time `asn1:"generalized,explicit,tag:0,optional"`
+  Extensions []asn1.RawValue `asn1:"explicit,tag:1,optional"`
+}
+
+// a CertID names the certificate a single response is about
+type ocspCertID struct {
+  HashAlgorithm pkix.AlgorithmIdentifier
+  IssuerNameHash []byte
+  IssuerKeyHash []byte
+  SerialNumber *big.Int
+}
+
+// the hashes a CertID may use
+var ocspHashes = map[string]crypto.Hash{
+  "1.3.14.3.2.26": crypto.SHA1,
+  "2.16.840.1.101.3.4.2.1": crypto.SHA256,
+  "2.16.840.1.101.3.4.2.2": crypto.SHA384,
+  "2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+// oidOCSPBasic identifies a BasicOCSPResponse
+var oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+// errNoStaple is the error of a handshake without a stapled response
+var errNoStaple = errors.New("ocsp: no stapled response")
+
+// checkOCSP returns an error unless the handshake stapled
+// a successful, current OCSP response saying the leaf is good
+// the response is matched to the leaf by its CertID,
+// which needs the issuer in the chain the server sent
+func checkOCSP(cs *tls.ConnectionState) error {
+  if cs == nil {
+    return fmt.Errorf("ocsp: not a TLS connection")
+  }
+  if len(cs.OCSPResponse) == 0 {
+    return errNoStaple
+  }
+  var resp ocspResponse
+  if _, err := asn1.Unmarshal(cs.OCSPResponse, &resp); err != nil {
+    return fmt.Errorf("ocsp: malformed response: %v", err)
+  }
+  if resp.Status != 0 {
+    return fmt.Errorf("ocsp: response status %d", resp.Status)
+  }
+  if !resp.Bytes.Type.Equal(oidOCSPBasic) {
+    return fmt.Errorf("ocsp: unsupported response type %v", resp.Bytes.Type)
+  }
+  var basic ocspBasicResponse
+  if _, err := asn1.Unmarshal(resp.Bytes.Response, &basic); err != nil {
+    return fmt.Errorf("ocsp: malformed basic response: %v", err)
+  }
+  if len(cs.PeerCertificates) < 2 {
+    return fmt.Errorf("ocsp: no issuer certificate to match the response to")
+  }
+  leaf, issuer := cs.PeerCertificates[0], cs.PeerCertificates[1]
+  var single *ocspSingleResponse
+  for i := range basic.Data.Responses {
+    if certIDMatches(basic.Data.Responses[i].CertID, leaf, issuer) {
+      single = &basic.Data.Responses[i]
+      break
+    }
+  }
+  if single == nil {
+    return fmt.Errorf("ocsp: no status for the server's certificate")
+  }
+  if single.Status.Class != asn1.ClassContextSpecific {
+    return fmt.Errorf("ocsp: malformed certificate status")
+  }
+  switch single.Status.Tag {
+  case 0:
+  case 1:
+    return fmt.Errorf("ocsp: certificate revoked")
+  default:
+    return fmt.Errorf("ocsp: certificate status unknown")
+  }
+  if !single.NextUpdate.IsZero() && time.Now().After(single.NextUpdate) {
+    return fmt.Errorf("ocsp: stapled response expired %v", single.NextUpdate.UTC().Format(time.RFC3339))
+  }
+  return nil
+}
+
+// certIDMatches reports whether id names leaf, issued by issuer:
+// the serial and the hashes of the issuer's name and key must match
+func certIDMatches(id ocspCertID, leaf, issuer *x509.Certificate) bool {
+  if id.SerialNumber == nil || id.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+    return false
+  }
+  h, ok := ocspHashes[id.HashAlgorithm.Algorithm.String()]
+  if !ok || !h.Available() {
+    return false
+  }
+  var spki struct {
+    Algorithm pkix.AlgorithmIdentifier
+    PublicKey asn1.BitString
+  }
+  if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+    return false
+  }
+  name, key := h.New(), h.New()
+  name.Write(issuer.RawSubject)
+  key.Write(spki.PublicKey.RightAlign())
+  return bytes.Equal(id.IssuerNameHash, name.Sum(nil)) && bytes.Equal(id.IssuerKeyHash, key.Sum(nil))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/asn1"
+  "math/big"
+  "strings"
+  "testing"
+  "time"
+)
+
+// testChain returns a leaf certificate with serial 42 and the CA that issued it
+func testChain(t *testing.T) (leaf, ca *x509.Certificate) {
+  t.Helper()
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    t.Fatal(err)
+  }
+  caTmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test CA"},
+    NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+    IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+  der, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &key.PublicKey, key)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if ca, err = x509.ParseCertificate(der); err != nil {
+    t.Fatal(err)
+  }
+  leafTmpl := &x509.Certificate{SerialNumber: big.NewInt(42), Subject: pkix.Name{CommonName: "example.com"},
+    NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+  if der, err = x509.CreateCertificate(rand.Reader, leafTmpl, ca, &key.PublicKey, key); err != nil {
+    t.Fatal(err)
+  }
+  if leaf, err = x509.ParseCertificate(der); err != nil {
+    t.Fatal(err)
+  }
+  return leaf, ca
+}
+
+// certID names the certificate with serial issued by ca, hashed with SHA-256
+func certID(t *testing.T, ca *x509.Certificate, serial int64) ocspCertID {
+  t.Helper()
+  var spki struct {
+    Algorithm pkix.AlgorithmIdentifier
+    PublicKey asn1.BitString
+  }
+  if _, err := asn1.Unmarshal(ca.RawSubjectPublicKeyInfo, &spki); err != nil {
+    t.Fatal(err)
+  }
+  name, key := crypto.SHA256.New(), crypto.SHA256.New()
+  name.Write(ca.RawSubject)
+  key.Write(spki.PublicKey.RightAlign())
+  return ocspCertID{
+    HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}},
+    IssuerNameHash: name.Sum(nil),
+    IssuerKeyHash: key.Sum(nil),
+    SerialNumber: big.NewInt(serial),
+  }
+}
+
+func mustMarshal(t *testing.T, v interface{}, params string) []byte {
+  t.Helper()
+  b, err := asn1.MarshalWithParams(v, params)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return b
+}
+
+// certificate statuses of a single response
+var (
+  ocspGood = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0}
+  ocspUnknown = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2}
+)
+
+func ocspRevoked(t *testing.T) asn1.RawValue {
+  return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true,
+    Bytes: mustMarshal(t, time.Now().Add(-time.Hour).UTC(), "generalized")}
+}
+
+// staple builds an unsigned OCSP response holding singles
+func staple(t *testing.T, singles ...ocspSingleResponse) []byte {
+  t.Helper()
+  basic := ocspBasicResponse{
+    Data: ocspResponseData{
+      ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: mustMarshal(t, []byte("key"), "")},
+      ProducedAt: time.Now().UTC().Truncate(time.Second),
+      Responses: singles,
+    },
+    Algorithm: asn1.RawValue{FullBytes: mustMarshal(t, pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}}, "")},
+    Signature: asn1.BitString{Bytes: []byte{0}, BitLength: 8},
+  }
+  return mustMarshal(t, ocspResponse{Bytes: ocspResponseBytes{Type: oidOCSPBasic, Response: mustMarshal(t, basic, "")}}, "")
+}
+
+func single(id ocspCertID, status asn1.RawValue, nextUpdate time.Time) ocspSingleResponse {
+  return ocspSingleResponse{CertID: id, Status: status,
+    ThisUpdate: time.Now().Add(-time.Hour).UTC().Truncate(time.Second), NextUpdate: nextUpdate.UTC().Truncate(time.Second)}
+}
+
+func TestCheckOCSP(t *testing.T) {
+  leaf, ca := testChain(t)
+  _, otherCA := testChain(t)
+  id := certID(t, ca, 42)
+  later := time.Now().Add(time.Hour)
+  cases := []struct {
+    name string
+    staple []byte
+    err string // "" when the check passes
+  }{
+    {"none", nil, "no stapled response"},
+    {"good", staple(t, single(id, ocspGood, later)), ""},
+    {"good without nextUpdate", staple(t, single(id, ocspGood, time.Time{})), ""},
+    {"revoked", staple(t, single(id, ocspRevoked(t), later)), "revoked"},
+    {"unknown", staple(t, single(id, ocspUnknown, later)), "status unknown"},
+    {"expired", staple(t, single(id, ocspGood, time.Now().Add(-time.Minute))), "expired"},
+    {"other serial", staple(t, single(certID(t, ca, 43), ocspGood, later)), "no status for the server's certificate"},
+    {"other issuer", staple(t, single(certID(t, otherCA, 42), ocspGood, later)), "no status for the server's certificate"},
+    {"leaf after another certificate", staple(t, single(certID(t, ca, 43), ocspRevoked(t), later), single(id, ocspGood, later)), ""},
+    {"malformed", []byte{0x30, 0x03, 0x0a}, "malformed response"},
+  }
+  for _, c := range cases {
+    err := checkOCSP(&tls.ConnectionState{OCSPResponse: c.staple, PeerCertificates: []*x509.Certificate{leaf, ca}})
+    switch {
+    case c.err == "" && err != nil:
+      t.Errorf("%s: %v", c.name, err)
+    case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+      t.Errorf("%s: error %v, want %q", c.name, err, c.err)
+    }
+  }
+
+  // without the issuer there is nothing to match the CertID to
+  err := checkOCSP(&tls.ConnectionState{OCSPResponse: staple(t, single(id, ocspGood, later)), PeerCertificates: []*x509.Certificate{leaf}})
+  if err == nil || !strings.Contains(err.Error(), "no issuer") {
+    t.Errorf("leaf only: error %v", err)
+  }
+}
@@ -0,0 +1,86 @@
+package main
+// -once: polling every URL a single time for pipeline gating
+// with an optional JSON manifest of the results for the next step
+
+import (
+  "encoding/json"
+  "log"
+  "os"
+  "time"
+)
+
+// a manifestEntry is one URL's result in the -manifest file
+type manifestEntry struct {
+  URL string `json:"url"`
+  Healthy bool `json:"healthy"`
+  Blocked bool `json:"blocked"`
+  Degraded bool `json:"degraded"`
+  Status string `json:"status"`
+  Code int `json:"code"`
+  LatencyMS float64 `json:"latency_ms"`
+  Checked time.Time `json:"checked"`
+}
+
+// a manifest is the -manifest file
+// pass is false when any URL failed, matching the exit code
+type manifest struct {
+  Pass bool `json:"pass"`
+  Marker string `json:"marker,omitempty"`
+  URLs []manifestEntry `json:"urls"`
+}
+
+// runOnce polls each resource once, in dependency order,
+// and returns the exit code: 0 if every URL was healthy, 1 if not
+// a URL blocked by an unhealthy dependency counts as failing
+func runOnce(rs []*Resource) int {
+  in, out := make(chan *Resource), make(chan *Resource)
+  status, health := make(chan State), make(chan healthQuery)
+  go Poller(in, out, status, health)
+
+  // the states so far answer the Poller's dependency queries
+  // as the StateMonitor would
+  states := make(map[string]State)
+  m := manifest{Pass: true, Marker: *deployMarker, URLs: []manifestEntry{}}
+  for _, r := range rs {
+    r.queued = time.Now()
+    in <- r
+    for done := false; !done; {
+      select {
+      case s := <-status:
+        states[s.url] = s
+        if !s.healthy {
+          m.Pass = false
+        }
+        log.Println("Result", s.url, s.status)
+        m.URLs = append(m.URLs, manifestEntry{URL: s.url, Healthy: s.healthy, Blocked: s.blocked, Degraded: s.degraded,
+          Status: s.status, Code: s.code, LatencyMS: float64(s.latency) / float64(time.Millisecond), Checked: s.checked.UTC()})
+      case q := <-health:
+        s, ok := states[q.url]
+        q.reply <- !ok || s.healthy
+      case <-out:
+        done = true
+      }
+    }
+  }
+  close(in)
+
+  if *manifestPath != "" {
+    if err := writeManifest(*manifestPath, m); err != nil {
+      log.Println("Error manifest", err)
+      return 1
+    }
+  }
+  if !m.Pass {
+    return 1
+  }
+  return 0
+}
+
+// writeManifest writes m to path as indented JSON
+func writeManifest(path string, m manifest) error {
+  b, err := json.MarshalIndent(m, "", "  ")
+  if err != nil {
+    return err
+  }
+  return os.WriteFile(path, append(b, '\n'), 0644)
+}
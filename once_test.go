@@ -0,0 +1,75 @@
+package main
+
+import (
+  "encoding/json"
+  "io"
+  "log"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestRunOnce(t *testing.T) {
+  ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  defer ok.Close()
+  broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusInternalServerError)
+  }))
+  defer broken.Close()
+  savedPath, savedMarker := *manifestPath, *deployMarker
+  t.Cleanup(func() { *manifestPath, *deployMarker = savedPath, savedMarker })
+  *manifestPath, *deployMarker = filepath.Join(t.TempDir(), "manifest.json"), "v42"
+  log.SetOutput(io.Discard)
+  t.Cleanup(func() { log.SetOutput(os.Stderr) })
+  read := func() manifest {
+    var m manifest
+    b, err := os.ReadFile(*manifestPath)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if err := json.Unmarshal(b, &m); err != nil {
+      t.Fatal(err)
+    }
+    return m
+  }
+
+  if code := runOnce([]*Resource{{url: ok.URL + "/a"}, {url: ok.URL + "/b"}}); code != 0 {
+    t.Fatalf("all healthy: exit code %d", code)
+  }
+  m := read()
+  if !m.Pass || m.Marker != "v42" || len(m.URLs) != 2 {
+    t.Fatalf("all healthy: manifest %+v", m)
+  }
+  for _, e := range m.URLs {
+    if !e.Healthy || e.Code != 200 || e.Status != "200 OK" || e.Checked.IsZero() {
+      t.Fatalf("healthy entry %+v", e)
+    }
+  }
+
+  // a failing URL fails the run, and so does the one it blocks
+  rs := []*Resource{{url: ok.URL}, {url: broken.URL}, {url: ok.URL + "/dep", dependsOn: broken.URL}}
+  if code := runOnce(rs); code != 1 {
+    t.Fatalf("one failing: exit code %d", code)
+  }
+  m = read()
+  if m.Pass || len(m.URLs) != 3 {
+    t.Fatalf("one failing: manifest %+v", m)
+  }
+  want := []struct {
+    url string
+    healthy, blocked bool
+    code int
+  }{
+    {ok.URL, true, false, 200},
+    {broken.URL, false, false, 500},
+    {ok.URL + "/dep", false, true, 0},
+  }
+  for i, w := range want {
+    e := m.URLs[i]
+    if e.URL != w.url || e.Healthy != w.healthy || e.Blocked != w.blocked || e.Code != w.code {
+      t.Errorf("entry %d: %+v, want %+v", i, e, w)
+    }
+  }
+}
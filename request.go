@@ -0,0 +1,124 @@
+package main
+// building the request a poll sends
+
+import (
+  "bytes"
+  "compress/gzip"
+  "context"
+  "crypto/tls"
+  "io"
+  "math/rand/v2"
+  "net/http"
+  "net/http/httptrace"
+  "net/url"
+  "strconv"
+)
+
+// newRequest returns the request for one poll of r
+// it is a HEAD unless r sets a method, sends a body (POST)
+// or the response body has expectations to meet (GET)
+// a non-empty method overrides all of that and sends no body,
+// the way download forces a GET
+func (r *Resource) newRequest(ctx context.Context, method string) (*http.Request, error) {
+  var body io.Reader
+  if method == "" {
+    method = r.method
+    switch {
+    case method != "":
+    case r.body != "":
+      method = http.MethodPost
+    case r.needsBody():
+      method = http.MethodGet
+    default:
+      method = http.MethodHead
+    }
+    var err error
+    if body, err = r.requestBody(); err != nil {
+      return nil, err
+    }
+  }
+  target, err := r.target()
+  if err != nil {
+    return nil, err
+  }
+  // only a new connection does a TLS handshake, see gotConn
+  r.tlsHost, r.resumed = "", false
+  var host string
+  ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+    GetConn: func(hostPort string) { host = hostPort },
+    GotConn: func(info httptrace.GotConnInfo) { r.gotConn(host, info) },
+  })
+  req, err := http.NewRequestWithContext(ctx, method, target, body)
+  if err != nil {
+    return nil, err
+  }
+  if r.compressRequest && body != nil {
+    req.Header.Set("Content-Encoding", "gzip")
+  }
+  if r.tokens != nil {
+    token, err := r.tokens.get(ctx)
+    if err != nil {
+      return nil, err
+    }
+    req.Header.Set("Authorization", "Bearer "+token)
+  }
+  // after a connection failure the host may have failed over,
+  // so this request's connection isn't kept for the next one to reuse
+  // the shared client's other connections are left alone
+  req.Close = r.closeConnection || r.reconnect
+  r.reconnect = false
+  return req, nil
+}
+
+// gotConn records the TLS handshake of a new connection to host
+// a reused keep-alive connection did none for this poll,
+// so it isn't counted as a full handshake or a resumption
+func (r *Resource) gotConn(host string, info httptrace.GotConnInfo) {
+  tc, ok := info.Conn.(*tls.Conn)
+  if info.Reused || !ok {
+    return
+  }
+  r.tlsHost, r.resumed = host, tc.ConnectionState().DidResume
+}
+
+// target returns the URL to request, with r.query merged
+// into any query the URL already has
+// and a fresh cache buster when cacheBust is set
+func (r *Resource) target() (string, error) {
+  if len(r.query) == 0 && !r.cacheBust {
+    return r.url, nil
+  }
+  u, err := url.Parse(r.url)
+  if err != nil {
+    return "", err
+  }
+  q := u.Query()
+  for k, v := range r.query {
+    q.Set(k, v)
+  }
+  if r.cacheBust {
+    q.Set("_cb", strconv.FormatUint(rand.Uint64(), 36))
+  }
+  u.RawQuery = q.Encode()
+  return u.String(), nil
+}
+
+// requestBody returns r's body, gzipped when compressRequest is set
+// it is a *bytes.Reader so the request can rewind it for retries
+func (r *Resource) requestBody() (io.Reader, error) {
+  if r.body == "" {
+    return nil, nil
+  }
+  if !r.compressRequest {
+    return bytes.NewReader([]byte(r.body)), nil
+  }
+  var b bytes.Buffer
+  zw := gzip.NewWriter(&b)
+  if _, err := zw.Write([]byte(r.body)); err != nil {
+    return nil, err
+  }
+  if err := zw.Close(); err != nil {
+    return nil, err
+  }
+  return bytes.NewReader(b.Bytes()), nil
+}
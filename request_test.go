@@ -0,0 +1,112 @@
+package main
+
+import (
+  "compress/gzip"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "reflect"
+  "testing"
+)
+
+func TestCompressedBody(t *testing.T) {
+  var method, encoding, body string
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    method, encoding = r.Method, r.Header.Get("Content-Encoding")
+    var rd io.Reader = r.Body
+    if encoding == "gzip" {
+      zr, err := gzip.NewReader(r.Body)
+      if err != nil {
+        w.WriteHeader(http.StatusBadRequest)
+        return
+      }
+      rd = zr
+    }
+    b, err := io.ReadAll(rd)
+    if err != nil {
+      w.WriteHeader(http.StatusBadRequest)
+      return
+    }
+    body = string(b)
+  }))
+  defer ts.Close()
+
+  for _, compress := range []bool{false, true} {
+    r := &Resource{url: ts.URL, body: `{"probe":true}`, compressRequest: compress}
+    if s := r.Poll(); s != "200 OK" {
+      t.Fatalf("compress %v: %s", compress, s)
+    }
+    // a body without a method is a POST
+    if method != http.MethodPost || body != `{"probe":true}` {
+      t.Fatalf("compress %v: server got %s %q", compress, method, body)
+    }
+    if (encoding == "gzip") != compress {
+      t.Fatalf("compress %v: Content-Encoding %q", compress, encoding)
+    }
+  }
+}
+
+func TestQuery(t *testing.T) {
+  var got url.Values
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    got = r.URL.Query()
+  }))
+  defer ts.Close()
+
+  cases := []struct {
+    url string
+    query map[string]string
+    want url.Values
+  }{
+    {ts.URL + "/health", map[string]string{"check": "deep"}, url.Values{"check": {"deep"}}},
+    // existing parameters are kept, a parameter in both takes the resource's value
+    {ts.URL + "/health?region=eu&check=shallow", map[string]string{"check": "deep", "v": "2"},
+      url.Values{"region": {"eu"}, "check": {"deep"}, "v": {"2"}}},
+    // values are encoded
+    {ts.URL + "/health", map[string]string{"q": "a b&c=d/é"}, url.Values{"q": {"a b&c=d/é"}}},
+  }
+  for _, c := range cases {
+    got = nil
+    r := &Resource{url: c.url, query: c.query}
+    if s := r.Poll(); s != "200 OK" {
+      t.Fatalf("%s: %s", c.url, s)
+    }
+    if !reflect.DeepEqual(got, c.want) {
+      t.Errorf("%s with %v: server got %v, want %v", c.url, c.query, got, c.want)
+    }
+  }
+}
+
+func TestCacheBust(t *testing.T) {
+  var got []url.Values
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    got = append(got, r.URL.Query())
+  }))
+  defer ts.Close()
+
+  r := &Resource{url: ts.URL + "/?region=eu", query: map[string]string{"check": "deep"}, cacheBust: true}
+  for i := 0; i < 5; i++ {
+    if s := r.Poll(); s != "200 OK" {
+      t.Fatalf("poll %d: %s", i, s)
+    }
+  }
+  seen := make(map[string]bool)
+  for i, q := range got {
+    cb := q.Get("_cb")
+    if cb == "" || seen[cb] {
+      t.Fatalf("poll %d: cache buster %q, want a new one each poll", i, cb)
+    }
+    seen[cb] = true
+    if q.Get("region") != "eu" || q.Get("check") != "deep" || len(q) != 3 {
+      t.Fatalf("poll %d: query %v, want region and check kept beside _cb", i, q)
+    }
+  }
+
+  // without cacheBust the URL is sent as it is
+  got = nil
+  (&Resource{url: ts.URL + "/?region=eu"}).Poll()
+  if _, ok := got[0]["_cb"]; ok {
+    t.Fatal("cache buster sent without cacheBust")
+  }
+}
@@ -0,0 +1,28 @@
+package main
+// splitting the URLs between coordinated monitors
+// with -shard-index and -shard-count
+
+// shardOf returns the shard of url among count shards
+// it depends only on the URL, so every instance agrees on it
+func shardOf(url string, count int) int {
+  return int(urlHash(url) % uint64(count))
+}
+
+// shard returns the resources of ordered that belong to shard index
+// a resource goes with the root of its dependency chain,
+// so a dependency is always polled by the same instance as its dependents
+// ordered must come from orderDependencies
+func shard(ordered []*Resource, index, count int) []*Resource {
+  root := make(map[string]string)
+  var mine []*Resource
+  for _, r := range ordered {
+    root[r.url] = r.url
+    if r.dependsOn != "" {
+      root[r.url] = root[r.dependsOn]
+    }
+    if shardOf(root[r.url], count) == index {
+      mine = append(mine, r)
+    }
+  }
+  return mine
+}
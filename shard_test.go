@@ -0,0 +1,68 @@
+package main
+
+import (
+  "fmt"
+  "testing"
+)
+
+func TestShard(t *testing.T) {
+  var rs []*Resource
+  for i := 0; i < 200; i++ {
+    r := &Resource{url: fmt.Sprintf("http://host%d.example/", i)}
+    // every tenth URL depends on the one before it
+    if i%10 == 9 {
+      r.dependsOn = rs[i-1].url
+    }
+    rs = append(rs, r)
+  }
+  ordered, err := orderDependencies(rs)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  const count = 4
+  owner := make(map[string]int)
+  for index := 0; index < count; index++ {
+    mine := shard(ordered, index, count)
+    if len(mine) == 0 {
+      t.Errorf("shard %d is empty", index)
+    }
+    for _, r := range mine {
+      if prev, ok := owner[r.url]; ok {
+        t.Fatalf("%s in shards %d and %d", r.url, prev, index)
+      }
+      owner[r.url] = index
+    }
+    // the assignment depends only on the URLs, not on an earlier call
+    again := shard(ordered, index, count)
+    if len(again) != len(mine) {
+      t.Fatalf("shard %d has %d resources, then %d", index, len(mine), len(again))
+    }
+    for i := range mine {
+      if again[i] != mine[i] {
+        t.Fatalf("shard %d changed between calls", index)
+      }
+    }
+  }
+  for _, r := range rs {
+    i, ok := owner[r.url]
+    if !ok {
+      t.Fatalf("%s in no shard", r.url)
+    }
+    if i != shardOf(r.url, count) && r.dependsOn == "" {
+      t.Errorf("%s in shard %d, shardOf says %d", r.url, i, shardOf(r.url, count))
+    }
+    if r.dependsOn != "" && owner[r.dependsOn] != i {
+      t.Errorf("%s in shard %d, its dependency in %d", r.url, i, owner[r.dependsOn])
+    }
+  }
+}
+
+func TestShardOfStable(t *testing.T) {
+  // FNV-1a is fixed, so monitors built at different times agree
+  for url, want := range map[string]int{"http://golang.org": 1, "http://host0.example/": 0} {
+    if got := shardOf(url, 4); got != want {
+      t.Errorf("shardOf(%s, 4) = %d, want %d", url, got, want)
+    }
+  }
+}
@@ -0,0 +1,41 @@
+package main
+// latency SLAs that depend on the time of day
+
+import "time"
+
+// an slaWindow is a daily span of local time with its own latency SLA
+// e.g. weekdays 9:00-17:00 at 200ms
+type slaWindow struct {
+  days []time.Weekday // days it applies on, every day when empty
+  start, end time.Duration // wall clock times of day, end exclusive
+  max time.Duration // slowest acceptable poll within the window
+}
+
+// contains reports whether t falls in the window
+func (w slaWindow) contains(t time.Time) bool {
+  if len(w.days) > 0 {
+    on := false
+    for _, d := range w.days {
+      on = on || d == t.Weekday()
+    }
+    if !on {
+      return false
+    }
+  }
+  // wall clock time, so a DST change doesn't move the window
+  offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+    time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+  return offset >= w.start && offset < w.end
+}
+
+// latencyLimit returns the latency SLA for a poll of r at t
+// the first window containing t wins, otherwise r.maxLatency applies
+// 0 means no limit
+func (r *Resource) latencyLimit(t time.Time) time.Duration {
+  for _, w := range r.latencySLA {
+    if w.contains(t) {
+      return w.max
+    }
+  }
+  return r.maxLatency
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+  "testing"
+  "time"
+)
+
+func TestSLAWindow(t *testing.T) {
+  ny, err := time.LoadLocation("America/New_York")
+  if err != nil {
+    t.Skip("no tz database:", err)
+  }
+  r := &Resource{maxLatency: time.Second, latencySLA: []slaWindow{
+    {days: []time.Weekday{time.Sunday}, start: 9 * time.Hour, end: 17 * time.Hour, max: 200 * time.Millisecond},
+  }}
+  cases := []struct {
+    t time.Time
+    want time.Duration
+  }{
+    // 2024-03-10 and 2024-11-03 are Sundays on which DST starts and ends
+    {time.Date(2024, 3, 10, 8, 59, 59, 0, ny), time.Second},
+    {time.Date(2024, 3, 10, 9, 0, 0, 0, ny), 200 * time.Millisecond},
+    {time.Date(2024, 3, 10, 16, 59, 59, 0, ny), 200 * time.Millisecond},
+    {time.Date(2024, 3, 10, 17, 0, 0, 0, ny), time.Second},
+    {time.Date(2024, 11, 3, 8, 59, 59, 0, ny), time.Second},
+    {time.Date(2024, 11, 3, 9, 0, 0, 0, ny), 200 * time.Millisecond},
+    {time.Date(2024, 11, 3, 16, 59, 59, 0, ny), 200 * time.Millisecond},
+    {time.Date(2024, 11, 3, 17, 0, 0, 0, ny), time.Second},
+    // an ordinary Sunday, and a Monday the window doesn't apply on
+    {time.Date(2024, 3, 17, 9, 0, 0, 0, ny), 200 * time.Millisecond},
+    {time.Date(2024, 3, 11, 12, 0, 0, 0, ny), time.Second},
+  }
+  for _, c := range cases {
+    if got := r.latencyLimit(c.t); got != c.want {
+      t.Errorf("%v: limit %v, want %v", c.t, got, c.want)
+    }
+  }
+}
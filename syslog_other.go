@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package main
+
+import "errors"
+
+// openSyslog fails, there is no syslog on this platform
+func openSyslog(facility, severity string) error {
+  return errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,111 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+  "fmt"
+  "log/syslog"
+  "strings"
+)
+
+var facilities = map[string]syslog.Priority{
+  "daemon": syslog.LOG_DAEMON,
+  "user": syslog.LOG_USER,
+  "local0": syslog.LOG_LOCAL0,
+  "local1": syslog.LOG_LOCAL1,
+  "local2": syslog.LOG_LOCAL2,
+  "local3": syslog.LOG_LOCAL3,
+  "local4": syslog.LOG_LOCAL4,
+  "local5": syslog.LOG_LOCAL5,
+  "local6": syslog.LOG_LOCAL6,
+  "local7": syslog.LOG_LOCAL7,
+}
+
+var severities = map[string]syslog.Priority{
+  "emerg": syslog.LOG_EMERG,
+  "alert": syslog.LOG_ALERT,
+  "crit": syslog.LOG_CRIT,
+  "err": syslog.LOG_ERR,
+  "warning": syslog.LOG_WARNING,
+  "notice": syslog.LOG_NOTICE,
+  "info": syslog.LOG_INFO,
+  "debug": syslog.LOG_DEBUG,
+}
+
+// a syslogNotifier sends each event at the severity mapped to it
+// the writer reconnects by itself when the daemon restarts
+type syslogNotifier struct {
+  w *syslog.Writer
+  severity map[string]syslog.Priority
+}
+
+func (n *syslogNotifier) notify(event, m string) error {
+  switch n.severity[event] {
+  case syslog.LOG_EMERG:
+    return n.w.Emerg(m)
+  case syslog.LOG_ALERT:
+    return n.w.Alert(m)
+  case syslog.LOG_CRIT:
+    return n.w.Crit(m)
+  case syslog.LOG_ERR:
+    return n.w.Err(m)
+  case syslog.LOG_WARNING:
+    return n.w.Warning(m)
+  case syslog.LOG_NOTICE:
+    return n.w.Notice(m)
+  case syslog.LOG_DEBUG:
+    return n.w.Debug(m)
+  }
+  return n.w.Info(m)
+}
+
+// severityMap parses a list like down=err,recovered=notice
+// events it leaves out keep their default: err for down and reminder,
+// notice for recovered and info for summary
+func severityMap(list string) (map[string]syslog.Priority, error) {
+  m := map[string]syslog.Priority{
+    "down": syslog.LOG_ERR,
+    "reminder": syslog.LOG_ERR,
+    "recovered": syslog.LOG_NOTICE,
+    "summary": syslog.LOG_INFO,
+  }
+  for _, kv := range strings.Split(list, ",") {
+    if kv = strings.TrimSpace(kv); kv == "" {
+      continue
+    }
+    event, sev, _ := strings.Cut(kv, "=")
+    if _, ok := m[event]; !ok {
+      return nil, fmt.Errorf("unknown syslog event %q", event)
+    }
+    p, ok := severities[sev]
+    if !ok {
+      return nil, fmt.Errorf("unknown syslog severity %q for %s", sev, event)
+    }
+    m[event] = p
+  }
+  return m, nil
+}
+
+// openSyslog connects sysNotifier to the local syslog daemon
+func openSyslog(facility, severity string) error {
+  return dialSyslog("", "", facility, severity)
+}
+
+// dialSyslog connects sysNotifier to the syslog daemon at raddr,
+// the local one when network and raddr are empty
+func dialSyslog(network, raddr, facility, severity string) error {
+  p, ok := facilities[facility]
+  if !ok {
+    return fmt.Errorf("unknown syslog facility %q", facility)
+  }
+  sev, err := severityMap(severity)
+  if err != nil {
+    return err
+  }
+  w, err := syslog.Dial(network, raddr, p|syslog.LOG_INFO, "codewalk")
+  if err != nil {
+    return err
+  }
+  sysNotifier = &syslogNotifier{w: w, severity: sev}
+  return nil
+}
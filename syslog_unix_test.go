@@ -0,0 +1,65 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+  "fmt"
+  "log/syslog"
+  "net"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestSyslog(t *testing.T) {
+  dir, err := os.MkdirTemp("", "syslog")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  addr := filepath.Join(dir, "log")
+  conn, err := net.ListenPacket("unixgram", addr)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer conn.Close()
+  if err := dialSyslog("unixgram", addr, "local3", "recovered=warning"); err != nil {
+    t.Fatal(err)
+  }
+  defer func() { sysNotifier = nil }()
+
+  notifyDown(State{url: "http://a", status: "503"})
+  notifyRecovered(State{url: "http://a", status: "200 OK", healthy: true})
+  notifySummary(map[string]State{"http://a": {healthy: true}, "http://b": {}})
+  want := []struct {
+    severity syslog.Priority
+    msg string
+  }{
+    {syslog.LOG_ERR, "event=down url=http://a"},
+    {syslog.LOG_WARNING, "event=recovered url=http://a"},
+    {syslog.LOG_INFO, "event=summary healthy=1 total=2"},
+  }
+  buf := make([]byte, 1024)
+  for _, w := range want {
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    n, _, err := conn.ReadFrom(buf)
+    if err != nil {
+      t.Fatal(err)
+    }
+    got := string(buf[:n])
+    prefix := fmt.Sprintf("<%d>", syslog.LOG_LOCAL3|w.severity)
+    if !strings.HasPrefix(got, prefix) || !strings.Contains(got, "codewalk[") || !strings.Contains(got, w.msg) {
+      t.Fatalf("got %q, want %s and %q", got, prefix, w.msg)
+    }
+  }
+}
+
+func TestSeverityMap(t *testing.T) {
+  for _, list := range []string{"down=loud", "outage=err", "down"} {
+    if _, err := severityMap(list); err == nil {
+      t.Errorf("%q: no error", list)
+    }
+  }
+}
@@ -0,0 +1,42 @@
+package main
+// request timeouts that adapt to a URL's recent timeouts
+
+import (
+  "errors"
+  "net"
+  "time"
+)
+
+// timeout returns the timeout of r's next request
+// each consecutive timeout doubles it up to maxTimeout (lengthen)
+// or halves it down to minTimeout (shorten)
+func (r *Resource) timeout() time.Duration {
+  t := requestTimeout
+  if r.requestTimeout > 0 {
+    t = r.requestTimeout
+  }
+  for i := 0; i < r.timeouts; i++ {
+    switch *timeoutPolicy {
+    case "lengthen":
+      if t *= 2; t > maxTimeout {
+        return maxTimeout
+      }
+    case "shorten":
+      if t /= 2; t < minTimeout {
+        return minTimeout
+      }
+    }
+  }
+  return t
+}
+
+// countTimeout counts consecutive failed polls that timed out
+// any other failure starts the count again
+func (r *Resource) countTimeout(err error) {
+  var ne net.Error
+  if errors.As(err, &ne) && ne.Timeout() {
+    r.timeouts++
+    return
+  }
+  r.timeouts = 0
+}
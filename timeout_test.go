@@ -0,0 +1,80 @@
+package main
+
+import (
+  "errors"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+// setTimeoutPolicy sets -timeout-policy for a test
+func setTimeoutPolicy(t *testing.T, policy string) {
+  t.Helper()
+  saved := *timeoutPolicy
+  *timeoutPolicy = policy
+  t.Cleanup(func() { *timeoutPolicy = saved })
+}
+
+func TestTimeoutLengthen(t *testing.T) {
+  setTimeoutPolicy(t, "lengthen")
+  hang := make(chan struct{})
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    select {
+    case <-hang:
+    case <-r.Context().Done():
+    }
+  }))
+  defer ts.Close()
+  defer close(hang)
+
+  r := &Resource{url: ts.URL, requestTimeout: 100 * time.Millisecond}
+  for _, want := range []time.Duration{100, 200, 400} {
+    want *= time.Millisecond
+    if got := r.timeout(); got != want {
+      t.Fatalf("after %d timeouts: timeout %v, want %v", r.timeouts, got, want)
+    }
+    start := time.Now()
+    r.Poll()
+    if d := time.Since(start); d < want || d > want+time.Second {
+      t.Fatalf("poll with timeout %v took %v", want, d)
+    }
+  }
+  if r.timeouts != 3 {
+    t.Fatalf("%d timeouts counted, want 3", r.timeouts)
+  }
+  // a healthy poll brings it back
+  r.recordSuccess()
+  if got := r.timeout(); got != 100*time.Millisecond {
+    t.Fatalf("after a healthy poll: timeout %v", got)
+  }
+}
+
+func TestTimeoutPolicies(t *testing.T) {
+  timedOut := &net.DNSError{Err: "timeout", IsTimeout: true}
+  cases := []struct {
+    policy string
+    base time.Duration
+    want []time.Duration // after 0, 1, 2, ... timeouts in a row
+  }{
+    {"fixed", 10 * time.Second, []time.Duration{10 * time.Second, 10 * time.Second, 10 * time.Second}},
+    {"lengthen", 20 * time.Second, []time.Duration{20 * time.Second, 40 * time.Second, maxTimeout, maxTimeout}},
+    {"shorten", 4 * time.Second, []time.Duration{4 * time.Second, 2 * time.Second, minTimeout, minTimeout}},
+  }
+  for _, c := range cases {
+    setTimeoutPolicy(t, c.policy)
+    r := &Resource{requestTimeout: c.base}
+    for i, want := range c.want {
+      if got := r.timeout(); got != want {
+        t.Errorf("%s after %d timeouts: %v, want %v", c.policy, i, got, want)
+      }
+      r.countTimeout(timedOut)
+    }
+    // any other failure starts the count again
+    r.countTimeout(errors.New("connection refused"))
+    if got := r.timeout(); got != c.base {
+      t.Errorf("%s after another failure: %v, want %v", c.policy, got, c.base)
+    }
+  }
+}
@@ -0,0 +1,167 @@
+package main
+// bearer tokens for URLs behind short-lived OAuth2 client credentials
+// each token endpoint has a goroutine that owns its token
+// and refreshes it before it expires
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "log"
+  "net/http"
+  "net/url"
+  "strings"
+  "time"
+)
+
+const (
+  tokenRefreshAt = 0.8 // fraction of a token's lifetime after which it is refreshed
+  tokenRetry = 10 * time.Second // wait before retrying a failed refresh
+)
+
+// a tokenReply is the current token, or why there is none
+type tokenReply struct {
+  token string
+  err error
+}
+
+// a tokenManager hands out the current token of one endpoint
+// polls ask for it on requests, the manager goroutine answers
+// reply channels are buffered so it never waits on a poll that gave up
+type tokenManager struct {
+  requests chan chan tokenReply
+}
+
+// startTokens starts a tokenManager for each token endpoint in rs
+// resources with the same endpoint and client share one
+// it must run before any resource is polled
+func startTokens(rs []*Resource) {
+  managers := make(map[string]*tokenManager)
+  for _, r := range rs {
+    if r.tokenURL == "" {
+      continue
+    }
+    key := r.tokenURL + " " + r.tokenClientID
+    m := managers[key]
+    if m == nil {
+      m = &tokenManager{requests: make(chan chan tokenReply)}
+      go m.run(r.tokenURL, r.tokenClientID, r.tokenClientSecret)
+      managers[key] = m
+    }
+    r.tokens = m
+  }
+}
+
+// get returns the current token
+// it gives up when ctx is done, so a poll never waits longer than its timeout
+func (m *tokenManager) get(ctx context.Context) (string, error) {
+  reply := make(chan tokenReply, 1)
+  select {
+  case m.requests <- reply:
+  case <-ctx.Done():
+    return "", fmt.Errorf("token: %v", ctx.Err())
+  }
+  select {
+  case rep := <-reply:
+    return rep.token, rep.err
+  case <-ctx.Done():
+    return "", fmt.Errorf("token: %v", ctx.Err())
+  }
+}
+
+// a tokenFetch is the outcome of one fetchToken
+type tokenFetch struct {
+  token string
+  lifetime time.Duration
+  err error
+}
+
+// run fetches tokens in the background and answers requests
+// with the current one while a refresh is running
+// the next refresh starts after tokenRefreshAt of a token's lifetime
+// a failed refresh keeps handing out the old token until it expires
+// requests that arrive before the first fetch is done wait for it
+func (m *tokenManager) run(endpoint, id, secret string) {
+  fetched := make(chan tokenFetch)
+  fetch := func() {
+    go func() {
+      token, lifetime, err := fetchToken(endpoint, id, secret)
+      fetched <- tokenFetch{token, lifetime, err}
+    }()
+  }
+  var cur tokenReply
+  var expires time.Time
+  var refresh <-chan time.Time
+  var waiting []chan tokenReply // only until the first fetch is done
+  first := true
+  fetch()
+  for {
+    select {
+    case f := <-fetched:
+      if f.err != nil {
+        log.Println("Error token", endpoint, f.err)
+        if cur.token == "" {
+          cur.err = fmt.Errorf("token: %v", f.err)
+        }
+        refresh = time.After(tokenRetry)
+      } else {
+        log.Printf("Token from %s refreshed, expires in %v", endpoint, f.lifetime)
+        cur, expires = tokenReply{token: f.token}, time.Now().Add(f.lifetime)
+        refresh = time.After(time.Duration(float64(f.lifetime) * tokenRefreshAt))
+      }
+      first = false
+      for _, reply := range waiting {
+        reply <- cur
+      }
+      waiting = nil
+    case <-refresh:
+      refresh = nil
+      fetch()
+    case reply := <-m.requests:
+      if first {
+        waiting = append(waiting, reply)
+        continue
+      }
+      if cur.token != "" && time.Now().After(expires) {
+        cur = tokenReply{err: fmt.Errorf("token: expired, refresh failing")}
+      }
+      reply <- cur
+    }
+  }
+}
+
+// fetchToken asks endpoint for a client credentials token
+// giving up after requestTimeout
+// errors never include the response body, which may hold a token
+func fetchToken(endpoint, id, secret string) (string, time.Duration, error) {
+  ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+  defer cancel()
+  form := url.Values{"grant_type": {"client_credentials"}}
+  req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+  if err != nil {
+    return "", 0, err
+  }
+  req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  if id != "" {
+    req.SetBasicAuth(id, secret)
+  }
+  resp, err := client.Do(req)
+  if err != nil {
+    return "", 0, err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return "", 0, fmt.Errorf("token endpoint: %s", resp.Status)
+  }
+  var t struct {
+    AccessToken string `json:"access_token"`
+    ExpiresIn int `json:"expires_in"`
+  }
+  if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+    return "", 0, fmt.Errorf("token endpoint: invalid response")
+  }
+  if t.AccessToken == "" || t.ExpiresIn <= 0 {
+    return "", 0, fmt.Errorf("token endpoint: response without access_token and expires_in")
+  }
+  return t.AccessToken, time.Duration(t.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+func TestTokenRefresh(t *testing.T) {
+  var fetches atomic.Int32
+  hung := make(chan struct{})
+  tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if fetches.Add(1) > 1 {
+      // a hung refresh mustn't block polls while the old token is valid
+      <-hung
+      return
+    }
+    fmt.Fprint(w, `{"access_token":"token1","expires_in":5}`)
+  }))
+  defer tokens.Close()
+  defer close(hung)
+  api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.Header.Get("Authorization") != "Bearer token1" {
+      w.WriteHeader(http.StatusUnauthorized)
+    }
+  }))
+  defer api.Close()
+
+  r := &Resource{url: api.URL, requestTimeout: time.Second, tokenURL: tokens.URL}
+  startTokens([]*Resource{r})
+  if s := r.Poll(); s != "200 OK" {
+    t.Fatalf("poll: %s", s)
+  }
+  // the refresh starts at 80% of the 5s lifetime, before it expires
+  time.Sleep(4500 * time.Millisecond)
+  if n := fetches.Load(); n != 2 {
+    t.Fatalf("%d fetches, want a refresh before expiry", n)
+  }
+  start := time.Now()
+  if s := r.Poll(); s != "200 OK" {
+    t.Fatalf("poll during the refresh: %s", s)
+  }
+  if d := time.Since(start); d > 500*time.Millisecond {
+    t.Fatalf("poll took %v during a refresh", d)
+  }
+}
+
+func TestTokenHungEndpoint(t *testing.T) {
+  hung := make(chan struct{})
+  tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    <-hung
+  }))
+  defer tokens.Close()
+  defer close(hung)
+  r := &Resource{url: "http://127.0.0.1:1", requestTimeout: 200 * time.Millisecond, tokenURL: tokens.URL}
+  startTokens([]*Resource{r})
+  start := time.Now()
+  r.Poll()
+  if r.errCount != 1 {
+    t.Fatal("poll without a token succeeded")
+  }
+  if d := time.Since(start); d > time.Second {
+    t.Fatalf("poll waited %v for a hung token endpoint, want about its 200ms timeout", d)
+  }
+}
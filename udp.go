@@ -0,0 +1,87 @@
+package main
+// sending poll results to a collector as compact UDP datagrams
+//
+// each datagram is one big-endian record:
+//
+//   offset size field
+//   0      2    length of the rest of the record (15)
+//   2      8    FNV-1a 64-bit hash of the URL
+//   10     2    HTTP status code, 0 without a response
+//   12     4    latency in microseconds, saturating at 2^32-1
+//   16     1    flags: 1 healthy, 2 blocked, 4 degraded
+//
+// collectors should skip bytes past the fields they know
+// so fields can be appended later
+
+import (
+  "encoding/binary"
+  "hash/fnv"
+  "log"
+  "math"
+  "net"
+)
+
+const (
+  flagHealthy = 1 << iota
+  flagBlocked
+  flagDegraded
+)
+
+// resultLen is the record length after the length prefix
+const resultLen = 15
+
+// collector is the UDP socket results are sent on, if any
+var collector net.Conn
+
+// openCollector connects collector to addr
+func openCollector(addr string) error {
+  c, err := net.Dial("udp", addr)
+  if err != nil {
+    return err
+  }
+  collector = c
+  return nil
+}
+
+// encodeResult returns the datagram for s
+func encodeResult(s State) []byte {
+  b := make([]byte, 2+resultLen)
+  binary.BigEndian.PutUint16(b[0:], resultLen)
+  binary.BigEndian.PutUint64(b[2:], urlHash(s.url))
+  binary.BigEndian.PutUint16(b[10:], uint16(s.code))
+  us := s.latency.Microseconds()
+  if us > math.MaxUint32 {
+    us = math.MaxUint32
+  }
+  binary.BigEndian.PutUint32(b[12:], uint32(us))
+  var flags byte
+  if s.healthy {
+    flags |= flagHealthy
+  }
+  if s.blocked {
+    flags |= flagBlocked
+  }
+  if s.degraded {
+    flags |= flagDegraded
+  }
+  b[16] = flags
+  return b
+}
+
+// urlHash returns the FNV-1a 64-bit hash of url
+func urlHash(url string) uint64 {
+  h := fnv.New64a()
+  h.Write([]byte(url))
+  return h.Sum64()
+}
+
+// sendResult sends s to the collector, if there is one
+// a lost datagram is only logged, it never holds up a Poller
+func sendResult(s State) {
+  if collector == nil {
+    return
+  }
+  if _, err := collector.Write(encodeResult(s)); err != nil {
+    log.Println("Error udp collector", err)
+  }
+}
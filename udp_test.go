@@ -0,0 +1,71 @@
+package main
+
+import (
+  "encoding/binary"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+func TestUDPResults(t *testing.T) {
+  conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer conn.Close()
+  if err := openCollector(conn.LocalAddr().String()); err != nil {
+    t.Fatal(err)
+  }
+  defer func() {
+    collector.Close()
+    collector = nil
+  }()
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path == "/broken" {
+      w.WriteHeader(http.StatusServiceUnavailable)
+    }
+  }))
+  defer ts.Close()
+
+  rs := []*Resource{{url: ts.URL + "/"}, {url: ts.URL + "/broken"}}
+  in, out := make(chan *Resource), make(chan *Resource)
+  status := make(chan State, len(rs))
+  go Poller(in, out, status, nil)
+  defer close(in)
+  for _, r := range rs {
+    r.queued = time.Now()
+    in <- r
+    <-out
+  }
+
+  buf := make([]byte, 64)
+  for _, want := range []int{200, 503} {
+    st := <-status
+    if st.code != want || st.healthy != (want == 200) {
+      t.Fatalf("%s: polled code %d healthy %v", st.url, st.code, st.healthy)
+    }
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    n, _, err := conn.ReadFrom(buf)
+    if err != nil {
+      t.Fatal(err)
+    }
+    b := buf[:n]
+    if n < 2+resultLen || binary.BigEndian.Uint16(b[0:]) != resultLen {
+      t.Fatalf("datagram % x", b)
+    }
+    if h := binary.BigEndian.Uint64(b[2:]); h != urlHash(st.url) {
+      t.Errorf("%s: url hash %x, want %x", st.url, h, urlHash(st.url))
+    }
+    if code := int(binary.BigEndian.Uint16(b[10:])); code != st.code {
+      t.Errorf("%s: code %d, want %d", st.url, code, st.code)
+    }
+    if us := int64(binary.BigEndian.Uint32(b[12:])); us != st.latency.Microseconds() {
+      t.Errorf("%s: latency %dus, want %dus", st.url, us, st.latency.Microseconds())
+    }
+    if healthy := b[16]&flagHealthy != 0; healthy != st.healthy {
+      t.Errorf("%s: healthy flag %v, want %v", st.url, healthy, st.healthy)
+    }
+  }
+}
@@ -0,0 +1,183 @@
+package main
+// posting transitions to a webhook
+// as a generic payload, Slack blocks or PagerDuty Events API v2
+// and, per resource, every poll result to a result webhook
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "net/http"
+  "time"
+)
+
+// webhookPayload returns the JSON body for an event about s
+// n is the reminder count of a reminder event
+func webhookPayload(format, event string, s State, n int) interface{} {
+  switch format {
+  case "slack":
+    return slackPayload(event, s, n)
+  case "pagerduty":
+    return pagerDutyPayload(event, s)
+  }
+  return map[string]interface{}{
+    "event": event,
+    "url": s.url,
+    "status": s.status,
+    "reminder": n,
+    "time": s.checked.UTC().Format(time.RFC3339),
+    "marker": s.marker,
+    "annotations": s.annotations,
+  }
+}
+
+// slackPayload is a message with a fallback text and one section block
+func slackPayload(event string, s State, n int) interface{} {
+  title := map[string]string{"down": "🔴 DOWN", "reminder": "🔴 STILL DOWN", "recovered": "🟢 RECOVERED"}[event]
+  if event == "reminder" {
+    title += fmt.Sprintf(" (reminder %d)", n)
+  }
+  if s.marker != "" {
+    title += " [" + s.marker + "]"
+  }
+  text := fmt.Sprintf("%s %s: %s", title, s.url, s.status)
+  detail := fmt.Sprintf("*%s* <%s>\n`%s`", title, s.url, s.status)
+  for _, k := range sortedKeys(s.annotations) {
+    detail += fmt.Sprintf("\n%s: %s", k, s.annotations[k])
+  }
+  return map[string]interface{}{
+    "text": text,
+    "blocks": []interface{}{
+      map[string]interface{}{
+        "type": "section",
+        "text": map[string]string{
+          "type": "mrkdwn",
+          "text": detail,
+        },
+      },
+    },
+  }
+}
+
+// pagerDutyPayload triggers or resolves the URL's incident
+// the dedup key is stable per URL, so reminders update the open incident
+// and a recovery resolves it
+func pagerDutyPayload(event string, s State) interface{} {
+  action := "trigger"
+  if event == "recovered" {
+    action = "resolve"
+  }
+  p := map[string]interface{}{
+    "routing_key": *webhookRoutingKey,
+    "event_action": action,
+    "dedup_key": dedupKey(s.url),
+  }
+  if action == "trigger" {
+    payload := map[string]interface{}{
+      "summary": fmt.Sprintf("%s is down: %s", s.url, s.status),
+      "source": s.url,
+      "severity": "critical",
+    }
+    details := make(map[string]string)
+    for k, v := range s.annotations {
+      details[k] = v
+    }
+    if s.marker != "" {
+      details["marker"] = s.marker
+    }
+    if len(details) > 0 {
+      payload["custom_details"] = details
+    }
+    p["payload"] = payload
+  }
+  return p
+}
+
+// dedupKey identifies a URL's incident across events
+func dedupKey(url string) string {
+  return fmt.Sprintf("codewalk-%016x", urlHash(url))
+}
+
+// sendWebhook posts an event to -webhook-url, if set
+// it posts from its own goroutine so the StateMonitor never waits on it,
+// and gives up after requestTimeout so a hung webhook can't pile them up
+func sendWebhook(event string, s State, n int) {
+  if *webhookURL == "" {
+    return
+  }
+  body, err := json.Marshal(webhookPayload(*webhookFormat, event, s, n))
+  if err != nil {
+    log.Println("Error webhook", err)
+    return
+  }
+  go func() {
+    if err := postJSON(*webhookURL, body); err != nil {
+      log.Println("Error webhook", err)
+    }
+  }()
+}
+
+// resultPosts limits the result webhook posts in flight
+var resultPosts = make(chan struct{}, maxResultPosts)
+
+// postResult sends st to r's resultWebhook, if it has one
+// results within resultWebhookInterval of the last post are skipped,
+// and so are results that find maxResultPosts already in flight
+// it is called by the Poller that owns r
+func (r *Resource) postResult(st State) {
+  if r.resultWebhook == "" || time.Since(r.lastResultPost) < r.resultWebhookInterval {
+    return
+  }
+  body, err := json.Marshal(map[string]interface{}{
+    "url": st.url,
+    "status": st.status,
+    "healthy": st.healthy,
+    "blocked": st.blocked,
+    "degraded": st.degraded,
+    "code": st.code,
+    "latency_ms": float64(st.latency) / float64(time.Millisecond),
+    "time": st.checked.UTC().Format(time.RFC3339Nano),
+    "marker": st.marker,
+  })
+  if err != nil {
+    log.Println("Error result webhook", err)
+    return
+  }
+  select {
+  case resultPosts <- struct{}{}:
+  default:
+    log.Println("Error result webhook", r.url, "dropped, too many posts in flight")
+    return
+  }
+  r.lastResultPost = time.Now()
+  go func(url string) {
+    defer func() { <-resultPosts }()
+    if err := postJSON(url, body); err != nil {
+      log.Println("Error result webhook", err)
+    }
+  }(r.resultWebhook)
+}
+
+// postJSON posts body to url, giving up after requestTimeout
+// so a hung endpoint can't hold on to a post for long
+func postJSON(url string, body []byte) error {
+  ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+  defer cancel()
+  req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+  if err != nil {
+    return err
+  }
+  req.Header.Set("Content-Type", "application/json")
+  resp, err := client.Do(req)
+  if err != nil {
+    return err
+  }
+  resp.Body.Close()
+  if resp.StatusCode >= 300 {
+    return errors.New(resp.Status)
+  }
+  return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+// postServer starts a server that sends each JSON object posted to it on the channel
+func postServer(t *testing.T) (*httptest.Server, <-chan map[string]interface{}) {
+  t.Helper()
+  posts := make(chan map[string]interface{}, 16)
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    var p map[string]interface{}
+    if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+      t.Errorf("invalid post: %v", err)
+    }
+    posts <- p
+  }))
+  t.Cleanup(ts.Close)
+  return ts, posts
+}
+
+// received returns the posts that arrive within wait
+func received(posts <-chan map[string]interface{}, wait time.Duration) []map[string]interface{} {
+  var got []map[string]interface{}
+  timeout := time.After(wait)
+  for {
+    select {
+    case p := <-posts:
+      got = append(got, p)
+    case <-timeout:
+      return got
+    }
+  }
+}
+
+func TestResultWebhook(t *testing.T) {
+  ts, posts := postServer(t)
+
+  // without an interval every poll is posted
+  r := &Resource{url: "http://a", resultWebhook: ts.URL}
+  for _, code := range []int{200, 503, 200} {
+    r.postResult(State{url: r.url, code: code, checked: time.Now()})
+  }
+  got := received(posts, 200*time.Millisecond)
+  if len(got) != 3 {
+    t.Fatalf("%d posts for 3 polls", len(got))
+  }
+  codes := map[float64]int{}
+  for _, p := range got {
+    if p["url"] != "http://a" {
+      t.Fatalf("post for %v", p["url"])
+    }
+    codes[p["code"].(float64)]++
+  }
+  if codes[200] != 2 || codes[503] != 1 {
+    t.Fatalf("posted codes %v, want 200 twice and 503 once", codes)
+  }
+
+  // polls within the interval of the last post are skipped
+  r = &Resource{url: "http://b", resultWebhook: ts.URL, resultWebhookInterval: time.Hour}
+  for i := 0; i < 3; i++ {
+    r.postResult(State{url: r.url, checked: time.Now()})
+  }
+  if got := received(posts, 200*time.Millisecond); len(got) != 1 {
+    t.Fatalf("%d posts within the interval, want 1", len(got))
+  }
+}
+
+// setWebhook points -webhook-url at url with format for a test
+func setWebhook(t *testing.T, url, format string) {
+  t.Helper()
+  savedURL, savedFormat := *webhookURL, *webhookFormat
+  *webhookURL, *webhookFormat = url, format
+  t.Cleanup(func() { *webhookURL, *webhookFormat = savedURL, savedFormat })
+}
+
+func TestSlackPayload(t *testing.T) {
+  ts, posts := postServer(t)
+  setWebhook(t, ts.URL, "slack")
+  sendWebhook("reminder", State{url: "http://a", status: "503 Service Unavailable", marker: "v2",
+    annotations: map[string]string{"team": "web"}}, 2)
+  got := received(posts, 200*time.Millisecond)
+  if len(got) != 1 {
+    t.Fatalf("%d posts, want 1", len(got))
+  }
+  if text := got[0]["text"]; text != "🔴 STILL DOWN (reminder 2) [v2] http://a: 503 Service Unavailable" {
+    t.Fatalf("fallback text %q", text)
+  }
+  blocks, _ := got[0]["blocks"].([]interface{})
+  if len(blocks) != 1 {
+    t.Fatalf("blocks %v, want one section", got[0]["blocks"])
+  }
+  section := blocks[0].(map[string]interface{})
+  text := section["text"].(map[string]interface{})
+  want := "*🔴 STILL DOWN (reminder 2) [v2]* <http://a>\n`503 Service Unavailable`\nteam: web"
+  if section["type"] != "section" || text["type"] != "mrkdwn" || text["text"] != want {
+    t.Fatalf("section %v", section)
+  }
+}
+
+func TestPagerDutyPayload(t *testing.T) {
+  ts, posts := postServer(t)
+  setWebhook(t, ts.URL, "pagerduty")
+  savedKey := *webhookRoutingKey
+  *webhookRoutingKey = "rk"
+  t.Cleanup(func() { *webhookRoutingKey = savedKey })
+
+  down := State{url: "http://a", status: "503 Service Unavailable"}
+  sendWebhook("down", down, 0)
+  trigger := received(posts, 200*time.Millisecond)
+  sendWebhook("recovered", State{url: "http://a", status: "200 OK", healthy: true}, 0)
+  resolve := received(posts, 200*time.Millisecond)
+  sendWebhook("down", State{url: "http://b"}, 0)
+  other := received(posts, 200*time.Millisecond)
+  if len(trigger) != 1 || len(resolve) != 1 || len(other) != 1 {
+    t.Fatalf("%d, %d and %d posts, want one each", len(trigger), len(resolve), len(other))
+  }
+
+  if trigger[0]["event_action"] != "trigger" || trigger[0]["routing_key"] != "rk" {
+    t.Fatalf("trigger %v", trigger[0])
+  }
+  payload, _ := trigger[0]["payload"].(map[string]interface{})
+  if payload["summary"] != "http://a is down: 503 Service Unavailable" || payload["severity"] != "critical" {
+    t.Fatalf("trigger payload %v", payload)
+  }
+  if resolve[0]["event_action"] != "resolve" || resolve[0]["payload"] != nil {
+    t.Fatalf("resolve %v", resolve[0])
+  }
+  // the recovery resolves the incident the outage opened
+  key := trigger[0]["dedup_key"]
+  if key == nil || resolve[0]["dedup_key"] != key || other[0]["dedup_key"] == key {
+    t.Fatalf("dedup keys %v, %v and %v", key, resolve[0]["dedup_key"], other[0]["dedup_key"])
+  }
+}